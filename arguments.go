@@ -0,0 +1,111 @@
+package godutch
+
+//
+// ArgumentPolicy decides whether arguments informed by remote callers reach the
+// checks, the equivalent of "dont_blame_nrpe". Arguments are refused unless
+// the service allows them, and then are validated against the denied
+// characters and check specific rules: maximum amount of arguments, allowed
+// characters, and a pattern every argument must match.
+//
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// characters refused on arguments when not configured, NRPE's shell meta
+	// characters plus the ones used on variable and command substitution
+	ARGUMENTS_DEFAULT_DENIED_CHARS = "|`&><'\"\\[]{};$()\r\n"
+)
+
+//
+// Argument policy of a service, with check specific rules by check name.
+//
+type ArgumentPolicy struct {
+	allow       bool
+	deniedChars string
+	maxCount    map[string]int
+	chars       map[string]string
+	// invalid patterns are kept as nil, refusing the check's arguments
+	patterns map[string]*regexp.Regexp
+}
+
+// Creates the argument policy out of service configuration. Patterns that
+// don't compile are logged, and arguments of those checks are refused.
+func NewArgumentPolicy(cfg *ServiceConfig) *ArgumentPolicy {
+	var ap *ArgumentPolicy = &ArgumentPolicy{
+		allow:       cfg.AllowArguments,
+		deniedChars: cfg.ArgumentsDenied,
+		maxCount:    parseNamedValues(cfg.CheckArgsMax),
+		chars:       parseNamedStrings(cfg.CheckArgsChars),
+		patterns:    make(map[string]*regexp.Regexp),
+	}
+	var logger *Logger = DefaultLogger().With("component", "Config")
+	var check string
+	var pattern string
+	var err error
+
+	if ap.deniedChars == "" {
+		ap.deniedChars = ARGUMENTS_DEFAULT_DENIED_CHARS
+	}
+
+	for check, pattern = range parseNamedStrings(cfg.CheckArgsPattern) {
+		if ap.patterns[check], err = regexp.Compile(pattern); err != nil {
+			logger.With("check", check).Errorf(
+				"Invalid arguments pattern '%s', refusing arguments: %s",
+				pattern, err)
+		}
+	}
+
+	return ap
+}
+
+// Validates the arguments informed for a check, returns ErrArgumentsNotAllowed
+// describing the first violation.
+func (ap *ArgumentPolicy) Validate(check string, args []string) error {
+	var arg string
+	var max int
+	var chars string
+	var pattern *regexp.Regexp
+	var found bool
+	var i int
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	if !ap.allow {
+		return fmt.Errorf("%w: arguments are disabled", ErrArgumentsNotAllowed)
+	}
+
+	if max, found = ap.maxCount[check]; found && len(args) > max {
+		return fmt.Errorf("%w: '%s' takes up to %d argument(s), %d informed",
+			ErrArgumentsNotAllowed, check, max, len(args))
+	}
+
+	chars = ap.chars[check]
+	pattern, found = ap.patterns[check]
+
+	for i, arg = range args {
+		if strings.ContainsAny(arg, ap.deniedChars) {
+			return fmt.Errorf("%w: argument %d has denied characters",
+				ErrArgumentsNotAllowed, i+1)
+		}
+		if chars != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !strings.ContainsRune(chars, r)
+		}) >= 0 {
+			return fmt.Errorf("%w: argument %d has characters not allowed for '%s'",
+				ErrArgumentsNotAllowed, i+1, check)
+		}
+		if found && (pattern == nil || !pattern.MatchString(arg)) {
+			return fmt.Errorf("%w: argument %d does not match pattern of '%s'",
+				ErrArgumentsNotAllowed, i+1, check)
+		}
+	}
+
+	return nil
+}
+
+/* EOF */
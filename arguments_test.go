@@ -0,0 +1,70 @@
+package godutch_test
+
+import (
+	"errors"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestArgumentPolicyDisabled(t *testing.T) {
+	var ap *ArgumentPolicy = NewArgumentPolicy(&ServiceConfig{})
+	var err error
+
+	Convey("Should accept requests without arguments", t, func() {
+		So(ap.Validate("check_test", []string{}), ShouldEqual, nil)
+	})
+
+	Convey("Should refuse arguments by default", t, func() {
+		err = ap.Validate("check_test", []string{"-w", "1"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+}
+
+func TestArgumentPolicyValidate(t *testing.T) {
+	var ap *ArgumentPolicy = NewArgumentPolicy(&ServiceConfig{
+		AllowArguments:   true,
+		CheckArgsMax:     []string{"check_test:2", "check_none:0"},
+		CheckArgsChars:   []string{"check_disk:abcdefghijklmnopqrstuvwxyz/"},
+		CheckArgsPattern: []string{"check_test:^-?[0-9]+$", "check_broken:[0-9"},
+	})
+	var err error
+
+	Convey("Should accept arguments following check's rules", t, func() {
+		So(ap.Validate("check_test", []string{"10", "-20"}), ShouldEqual, nil)
+		So(ap.Validate("check_disk", []string{"/var/log"}), ShouldEqual, nil)
+		So(ap.Validate("check_other", []string{"any thing"}), ShouldEqual, nil)
+	})
+
+	Convey("Should refuse denied characters on any check", t, func() {
+		err = ap.Validate("check_other", []string{"ok", "$(reboot)"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "argument 2")
+		err = ap.Validate("check_other", []string{"a; rm -rf /"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+
+	Convey("Should refuse more arguments than allowed", t, func() {
+		err = ap.Validate("check_test", []string{"1", "2", "3"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+		err = ap.Validate("check_none", []string{"1"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+
+	Convey("Should refuse characters not allowed for the check", t, func() {
+		err = ap.Validate("check_disk", []string{"/var/log2"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+
+	Convey("Should refuse arguments not matching the pattern", t, func() {
+		err = ap.Validate("check_test", []string{"10", "ten"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+
+	Convey("Should refuse arguments when pattern is invalid", t, func() {
+		err = ap.Validate("check_broken", []string{"1"})
+		So(errors.Is(err, ErrArgumentsNotAllowed), ShouldBeTrue)
+	})
+}
+
+/* EOF */
@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 //
@@ -18,34 +20,54 @@ import (
 type BgCmd struct {
 	Name       string
 	SocketPath string
+	Transport  *Transport
 	Cmd        *exec.Cmd
+	mutex      sync.Mutex
 	command    []string
 	Env        []string
 	stdout     io.ReadCloser
 	stderr     io.ReadCloser
+	// called in background every time the command is started
+	onStart func(pid int)
+	// amount of time between SIGTERM and SIGKILL, when stopping
+	stopTimeout time.Duration
+	// closed when the running command exits
+	done   chan struct{}
+	logger *Logger
+	// last lines written by the command, and log file
+	output *OutputLog
 }
 
+const (
+	// maximum length of a line written by the command, longer lines are
+	// discarded along with the rest of the stream
+	BGCMD_MAX_LINE_SIZE = 1024 * 1024
+)
+
 // Creates a new BgCmd object, which will prepare socket and os/exec command to
 // run in background, after "Bootstrap".
 func NewBgCmd(containerCfg *ContainerConfig) *BgCmd {
-	var okay bool = false
-	var bg *BgCmd
-	var socketName string = fmt.Sprintf("godutch-%s.sock", containerCfg.Name)
-	var socketPath string = filepath.Join(containerCfg.SocketDir, socketName)
+	return NewBgCmdWithTransport(containerCfg, NewUnixTransport(containerCfg))
+}
 
-	if okay, _ = exists(socketPath); okay {
-		log.Printf("[BgCmd] [WARN] Socket already found at: '%s'", socketPath)
-	}
+// Creates a new BgCmd object using informed transport, the address to listen on
+// is informed to the background process via environment.
+func NewBgCmdWithTransport(containerCfg *ContainerConfig, t *Transport) *BgCmd {
+	var bg *BgCmd
 
 	bg = &BgCmd{
-		Name:       containerCfg.Name,
-		command:    containerCfg.Command,
-		SocketPath: socketPath,
+		Name:        containerCfg.Name,
+		command:     containerCfg.Command,
+		SocketPath:  t.Address,
+		Transport:   t,
+		stopTimeout: containerCfg.StopTimeoutOrDefault(),
+		output:      NewOutputLogFromConfig(containerCfg),
 	}
+	bg.SetLogger(DefaultLogger())
 
-	// socket information, basic commnicaton method with background process
-	os.Setenv("GODUTCH_SOCKET_PATH", "")
-	bg.Env = bg.setenv("GODUTCH_SOCKET_PATH", bg.SocketPath)
+	// transport information, basic commnicaton method with background process
+	os.Setenv(t.EnvName(), "")
+	bg.Env = bg.setenv(t.EnvName(), t.Address)
 
 	return bg
 }
@@ -54,21 +76,57 @@ func NewBgCmd(containerCfg *ContainerConfig) *BgCmd {
 // call, trowing stdout/stderr entries on log interface.
 func (bg *BgCmd) Serve() {
 	var err error
-	log.Println("[BgCmd] Starting to 'serve':", bg.Name)
+	var onStart func(pid int)
+	var pid int
+	var done chan struct{}
+	var cmd *exec.Cmd
+	var stdout io.Reader
+	var stderr io.Reader
+	bg.logger.Infof("Starting to 'serve': %s", bg.Name)
+
+	// on errors, returning will let the Supervisor try again later
+	bg.mutex.Lock()
+
+	// a socket left behind by a previous run would confuse the new process
+	if err = bg.Transport.Cleanup(); err != nil {
+		bg.mutex.Unlock()
+		return
+	}
 
 	if err = bg.spawnCmd(); err != nil {
-		log.Fatalln("[BgCmd] Spawn error:", err)
+		bg.mutex.Unlock()
+		bg.logger.Errorf("Spawn error: %s", err)
+		return
 	}
 
 	if err = bg.Cmd.Start(); err != nil {
-		log.Fatalln("[BgCmd] Start error:", err)
+		bg.mutex.Unlock()
+		bg.logger.Errorf("Start error: %s", err)
+		return
 	}
+	onStart = bg.onStart
+	pid = bg.Cmd.Process.Pid
+	cmd = bg.Cmd
+	stdout = bg.stdout
+	stderr = bg.stderr
+	done = make(chan struct{})
+	bg.done = done
+	bg.mutex.Unlock()
 
-	bg.captureOutput()
+	bg.logger.With("pid", pid).Infof("'%s' started with PID '%d'", bg.Name, pid)
+	if onStart != nil {
+		go onStart(pid)
+	}
+
+	// both streams must be read until closed before waiting for the command
+	bg.captureOutput(stdout, stderr)
 
-	if err = bg.Cmd.Wait(); err != nil {
-		log.Println("[BgCmd] Wait error:", err)
+	if err = cmd.Wait(); err != nil {
+		bg.logger.Warnf("Wait error: %s", err)
 	}
+	bg.output.Write(OUTPUT_STREAM_EXIT, fmt.Sprintf(
+		"PID '%d' exited: %s", pid, cmd.ProcessState))
+	close(done)
 }
 
 // Handles the creation of a new exec.Command instance with informed parameters
@@ -91,12 +149,66 @@ func (bg *BgCmd) spawnCmd() error {
 	return nil
 }
 
-// Stop a background command.
+// Replaces the logger, entries carry the command name.
+func (bg *BgCmd) SetLogger(l *Logger) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+	bg.logger = l.With("component", "BgCmd").With("container", bg.Name)
+}
+
+// Registers a function to be called, in background, every time the command is
+// started, which includes restarts by the Supervisor.
+func (bg *BgCmd) OnStart(fn func(pid int)) {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+	bg.onStart = fn
+}
+
+// Stop a background command, asking it to terminate with SIGTERM, and using
+// SIGKILL when it's still running after the stop timeout.
 func (bg *BgCmd) Stop() {
+	var process *os.Process
+	var done chan struct{}
 	var err error
-	if err = bg.Cmd.Process.Kill(); err != nil {
-		log.Println("[BgCmd] Error on kill: ", err)
+
+	bg.mutex.Lock()
+	if bg.Cmd == nil || bg.Cmd.Process == nil {
+		bg.mutex.Unlock()
+		bg.logger.Debugf("Command is not running: %s", bg.Name)
+		return
 	}
+	process = bg.Cmd.Process
+	done = bg.done
+	bg.mutex.Unlock()
+
+	bg.logger.Infof("Terminating '%s' (PID '%d')", bg.Name, process.Pid)
+	if err = process.Signal(syscall.SIGTERM); err != nil {
+		bg.logger.Errorf("Error on terminate: %s", err)
+	}
+
+	select {
+	case <-done:
+		return
+	case <-time.After(bg.stopTimeout):
+		bg.logger.Warnf("'%s' still running after %s, killing.",
+			bg.Name, bg.stopTimeout)
+	}
+
+	if err = process.Kill(); err != nil {
+		bg.logger.Errorf("Error on kill: %s", err)
+	}
+}
+
+// Returns the process ID of the background command, or zero when it's not
+// started yet.
+func (bg *BgCmd) Pid() int {
+	bg.mutex.Lock()
+	defer bg.mutex.Unlock()
+
+	if bg.Cmd == nil || bg.Cmd.Process == nil {
+		return 0
+	}
+	return bg.Cmd.Process.Pid
 }
 
 // Helper method to set-up a valid environment slice, adding the informed
@@ -113,29 +225,61 @@ func (bg *BgCmd) setenv(key string, value string) []string {
 		if keyValue[0] == key && keyValue[1] != value {
 			newEntry = fmt.Sprintf("%s=%s", key, value)
 			newEnv = append(newEnv, newEntry)
-			log.Println("[BgCmd] ENV:", newEntry)
+			bg.logger.Debugf("ENV: %s", newEntry)
 		}
 	}
 
 	return newEnv
 }
 
-// Reads stdout and stderr io.Readers in a single Scanner, feeding the log
-// interface with what's found. Bufferized IO is used here, avoid blocking.
-func (bg *BgCmd) captureOutput() {
+// Reads stdout and stderr concurrently, so the command never blocks writing
+// on either of them, returns when both are closed.
+func (bg *BgCmd) captureOutput(stdout io.Reader, stderr io.Reader) {
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		bg.captureStream(OUTPUT_STREAM_STDOUT, stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		bg.captureStream(OUTPUT_STREAM_STDERR, stderr)
+	}()
+	wg.Wait()
+}
+
+// Reads a stream line by line, feeding the log interface and the output log
+// with what's found, tagged with the stream name. Lines are logged on debug
+// level, or warning when coming from stderr. On errors, like lines too long,
+// the rest of the stream is discarded.
+func (bg *BgCmd) captureStream(stream string, reader io.Reader) {
+	var scanner *bufio.Scanner = bufio.NewScanner(reader)
+	var logger *Logger = bg.logger.With("stream", stream)
 	var err error
-	var multi io.Reader
 
-	multi = io.MultiReader(bg.stdout, bg.stderr)
-	output := bufio.NewScanner(multi)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), BGCMD_MAX_LINE_SIZE)
 
-	for output.Scan() {
-		log.Println("[BgCmd] [", bg.Name, "STDOUT ]:", output.Text())
+	for scanner.Scan() {
+		if stream == OUTPUT_STREAM_STDERR {
+			logger.Warnf("%s", scanner.Text())
+		} else {
+			logger.Debugf("%s", scanner.Text())
+		}
+		if err = bg.output.Write(stream, scanner.Text()); err != nil {
+			logger.Warnf("Error on writing output log: %s", err)
+		}
 	}
 
-	if err = output.Err(); err != nil {
-		log.Println("[BgCmd] [", bg.Name, "STDERR ]:", err)
+	if err = scanner.Err(); err != nil {
+		logger.Errorf("Error on reading output: %s", err)
+		io.Copy(ioutil.Discard, reader)
 	}
 }
 
+// Returns the output log, last lines written by the command.
+func (bg *BgCmd) Output() *OutputLog {
+	return bg.output
+}
+
 /* EOF */
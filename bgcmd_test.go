@@ -6,6 +6,7 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewBgCmd(t *testing.T) {
@@ -25,4 +26,68 @@ func TestNewBgCmd(t *testing.T) {
 	})
 }
 
+// Serves the background command until it's stopped, returns a channel closed
+// once "serve" returns.
+func serveBgCmd(bg *BgCmd) chan struct{} {
+	var done chan struct{} = make(chan struct{})
+	var i int
+
+	go func() {
+		bg.Serve()
+		close(done)
+	}()
+
+	for i = 0; i < 100 && bg.Pid() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return done
+}
+
+func TestBgCmdStop(t *testing.T) {
+	var containerCfg *ContainerConfig
+	var bg *BgCmd
+	var done chan struct{}
+	var start time.Time
+
+	Convey("Should terminate the command with SIGTERM.", t, func() {
+		containerCfg = mockHelperContainerConfig("TestBgCmdStop", "check_a")
+		containerCfg.StopTimeout = 5
+		bg = NewBgCmd(containerCfg)
+		done = serveBgCmd(bg)
+		So(bg.Pid(), ShouldBeGreaterThan, 0)
+
+		start = time.Now()
+		bg.Stop()
+		So(time.Since(start), ShouldBeLessThan, 5*time.Second)
+		So(waitClosed(done, time.Second), ShouldBeTrue)
+	})
+
+	Convey("Should kill the command ignoring SIGTERM after timeout.", t, func() {
+		containerCfg = mockHelperContainerConfig(
+			"TestBgCmdStopKill", "+ignore-term", "+never")
+		containerCfg.StopTimeout = 1
+		bg = NewBgCmd(containerCfg)
+		done = serveBgCmd(bg)
+		So(bg.Pid(), ShouldBeGreaterThan, 0)
+		// giving the command time to ignore the signal
+		time.Sleep(200 * time.Millisecond)
+
+		start = time.Now()
+		bg.Stop()
+		So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+		So(waitClosed(done, time.Second), ShouldBeTrue)
+	})
+}
+
+// Waits for a channel to be closed, returns false after timeout.
+func waitClosed(ch chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 /* EOF */
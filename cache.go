@@ -0,0 +1,63 @@
+package godutch
+
+//
+// Helpers to inspect the shared cache, where Panamax stores the Responses of
+// every executed check, and from where the services pick them up to be
+// delivered on external end-points.
+//
+
+import (
+	gocache "github.com/patrickmn/go-cache"
+)
+
+// Walks through the cache items and collects the Responses that are not
+// expired, and were not yet dispatched, according to the informed map of sent
+// items (name and timestamp). Map of sent items is not modified here. Skipped
+// items are reported on informed logger.
+func pendingResponses(cache *gocache.Cache, sent map[string]int32, logger *Logger) map[string]*Response {
+	var itemName string
+	var item gocache.Item
+	var resp *Response
+	var okay bool
+	var sentTs int32
+	var found bool
+	var pending map[string]*Response = make(map[string]*Response)
+
+	for itemName, item = range cache.Items() {
+		if item.Expired() {
+			logger.With("check", itemName).Debugf("Item is expired: '%s'", itemName)
+			continue
+		}
+
+		// transforming from interface back into Response type
+		if resp, okay = item.Object.(*Response); !okay {
+			logger.With("check", itemName).Warnf(
+				"Item '%s' is not a Response, skipping.", itemName)
+			continue
+		}
+
+		// when the timestamp is already registered, it's been dispatched
+		if sentTs, found = sent[itemName]; found && sentTs >= resp.Ts {
+			continue
+		}
+
+		pending[itemName] = resp
+	}
+
+	return pending
+}
+
+// Copies the sent items (name and timestamp) of a service being replaced, kept
+// when newer than the ones already recorded.
+func copySent(sent map[string]int32, from map[string]int32) {
+	var itemName string
+	var ts int32
+
+	for itemName, ts = range from {
+		if sent[itemName] < ts {
+			sent[itemName] = ts
+		}
+	}
+}
+
+/* EOF */
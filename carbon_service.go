@@ -6,10 +6,13 @@ package godutch
 //
 
 import (
+	"errors"
 	"fmt"
 	gocarbon "github.com/jforman/carbon-golang"
 	gocache "github.com/patrickmn/go-cache"
-	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +23,10 @@ type CarbonService struct {
 	// respective timestamp, to avoid duplication
 	sentMetric map[string]int32
 	DialOn     []string
+	stopCh     chan struct{}
+	// metrics are sent by one caller at a time, serving loop or flush
+	mutex  sync.Mutex
+	logger *Logger
 }
 
 // Creates a new instance of CarbonService, which takes a cache object.
@@ -30,12 +37,27 @@ func NewCarbonService(cfg *ServiceConfig, cache *gocache.Cache) *CarbonService {
 		cache:      cache,
 		sentMetric: make(map[string]int32),
 		DialOn:     cfg.ParseDialOn(),
+		stopCh:     make(chan struct{}),
+		logger:     DefaultLogger().With("component", "Carbon"),
 	}
 	return cs
 }
 
-// Guards a local cache of sent metrics, when it's already sent it will return
-// true, otherwise update local cache and return false.
+// Replaces the logger.
+func (cs *CarbonService) SetLogger(l *Logger) {
+	cs.logger = l.With("component", "Carbon")
+}
+
+// Takes over the metrics already sent by the service being replaced, so they
+// are not sent again.
+func (cs *CarbonService) inheritSent(old *CarbonService) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	copySent(cs.sentMetric, old.sentMetric)
+}
+
+// Consults the local cache of sent metrics, returns true when the metric is
+// already sent with informed timestamp, or a newer one.
 func (cs *CarbonService) isMetricSent(name string, ts int32) bool {
 	var currentTs int32
 	var found bool
@@ -46,97 +68,107 @@ func (cs *CarbonService) isMetricSent(name string, ts int32) bool {
 		return true
 	}
 
-	// otherwise, updating the local cache, and returning false, the metric is
-	// not yet present
-	cs.sentMetric[name] = ts
-
 	return false
 }
 
 // Sends the metrics towards carbon server, first ask for gathering of the
 // values that will be transferred. It tries on the configured server end-points
-// sequentially, logging the results.
+// sequentially, logging the results. Metrics are recorded as sent only when
+// delivered, otherwise the last error is returned and they are tried again on
+// the next call.
 func (cs *CarbonService) Send() error {
 	var err error
 	var metrics []gocarbon.Metric
-	var i int
+	var pending map[string]int32
+	var name string
+	var ts int32
 	var dialStr string
 	var host string
 	var port int
 	var carbon *gocarbon.Carbon
-	var last int = len(cs.DialOn)
 
-	metrics = cs.extractMetricsFromCache()
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	metrics, pending = cs.extractMetricsFromCache()
 
 	if len(metrics) == 0 {
-		log.Println("[Carbon] No metrics to be sent, skipping.")
+		cs.logger.Debugf("No metrics to be sent, skipping.")
 		return nil
 	}
 
-	for i, dialStr = range cs.DialOn {
+	for _, dialStr = range cs.DialOn {
 		// extracting host and port from the dial-string
 		host, port = cs.cfg.ParseDialString(dialStr)
-		log.Printf("[Carbon] Connecting to: '%s:%d'", host, port)
+		cs.logger.Debugf("Connecting to: '%s:%d'", host, port)
 
 		// instantiating Carbon, which will try to connect immediately, and
 		// hence we can capture here connection errors, and try to use another
 		// host on the list
 		if carbon, err = gocarbon.NewCarbon(host, port, false, false); err != nil {
-			log.Printf("[Carbon] Error on connecting to: '%s:%d'", host, port)
-			log.Println("[Carbon] Error returned:", err)
-
-			// using DialOn index to know how many hosts can we still use on the
-			// connection attempts
-			if i >= last {
-				log.Println("[Carbon] No more hosts to try.")
-				// last know error is being returned, although, more erros might
-				// have been written to the logs
-				return err
-			} else {
-				continue
-			}
+			cs.logger.Errorf("Error on connecting to '%s:%d': %s", host, port, err)
+			continue
 		}
 
-		log.Printf("[Carbon] Sending '%d' metric(s) towards '%s:%d'",
+		cs.logger.Infof("Sending '%d' metric(s) towards '%s:%d'",
 			len(metrics), host, port)
 
 		if err = carbon.SendMetrics(metrics); err != nil {
-			log.Println("[Carbon] Send metrics returned error:", err)
+			cs.logger.Errorf("Send metrics returned error: %s", err)
 			continue
-		} else {
-			log.Println("[Carbon] Metrics sent!")
-			break
 		}
+
+		// metrics are delivered, marking them as sent
+		for name, ts = range pending {
+			cs.sentMetric[name] = ts
+		}
+
+		cs.logger.Infof("Metrics sent!")
+		return nil
+	}
+
+	if err == nil {
+		err = errors.New("[Carbon] No end-points to dial on.")
 	}
+	cs.logger.Errorf("No more hosts to try.")
 
-	return nil
+	// last know error is being returned, although, more erros might have been
+	// written to the logs
+	return err
 }
 
 // Search for cached items and their respective metrics to be sent into Carbon
 // service, cache object can't be expired and shall contain metrics before being
-// picked up.
-func (cs *CarbonService) extractMetricsFromCache() []gocarbon.Metric {
+// picked up. Returns the metrics, and the timestamp of each cache item they
+// came from, to be recorded once sent.
+func (cs *CarbonService) extractMetricsFromCache() (
+	[]gocarbon.Metric,
+	map[string]int32,
+) {
 	var itemName string
 	var item gocache.Item
 	var cached interface{}
 	var found bool
 	var resp *Response
-	var metric map[string]int
+	var metric Metric
 	var metricName string
-	var metricValue int
 	var metrics []gocarbon.Metric
+	var pending map[string]int32 = make(map[string]int32)
 
 	for itemName, item = range cs.cache.Items() {
-		log.Printf("[Carbon] Reading from cache: '%s'", itemName)
+		cs.logger.With("check", itemName).Debugf(
+			"Reading from cache: '%s'", itemName)
 
 		if item.Expired() {
-			log.Printf("[Carbon] Cache item is expired: '%s'", itemName)
+			cs.logger.With("check", itemName).Debugf(
+				"Cache item is expired: '%s'", itemName)
 			continue
 		}
 
 		// loading Response object from Cache
 		if cached, found = cs.cache.Get(itemName); !found {
-			log.Printf("[Carbon] Key is not found on Cache: '%s'", itemName)
+			cs.logger.With("check", itemName).Debugf(
+				"Key is not found on Cache: '%s'", itemName)
 			continue
 		} else {
 			// transforming from interface back into Response type
@@ -145,46 +177,83 @@ func (cs *CarbonService) extractMetricsFromCache() []gocarbon.Metric {
 
 		// checking whether are metrics to be sent
 		if len(resp.Metrics) <= 0 {
-			log.Printf("[Carbon] Cache entry '%s' has no metrics.", itemName)
+			cs.logger.With("check", itemName).Debugf(
+				"Cache entry '%s' has no metrics.", itemName)
 			continue
 		}
 
 		// checking if metric is already sent, by consulting local cache
 		if cs.isMetricSent(itemName, resp.Ts) {
-			log.Printf("[Carbon] Metric is dispatched: '%s' (timestamp %d)",
-				itemName, resp.Ts)
+			cs.logger.With("check", itemName).Debugf(
+				"Metric is dispatched: '%s' (timestamp %d)", itemName, resp.Ts)
 			continue
 		}
 
 		// finally, collecting the metrics
+		pending[itemName] = resp.Ts
 		for _, metric = range resp.Metrics {
-			for metricName, metricValue = range metric {
-				log.Printf("[Carbon] Collecting metric: '%s.%s' -> %d",
-					itemName, metricName, metricValue)
-
-				metrics = append(
-					metrics,
-					gocarbon.Metric{
-						Name:      fmt.Sprintf("%s.%s", itemName, metricName),
-						Value:     float64(metricValue),
-						Timestamp: int64(resp.Ts),
-					},
-				)
-			}
+			metricName = carbonMetricName(itemName, metric)
+			cs.logger.With("check", itemName).Debugf(
+				"Collecting metric: '%s' -> %g", metricName, metric.Value)
+
+			metrics = append(
+				metrics,
+				gocarbon.Metric{
+					Name:      metricName,
+					Value:     metric.Value,
+					Timestamp: metric.Timestamp(int64(resp.Ts)),
+				},
+			)
 		}
 	}
 
-	return metrics
+	return metrics, pending
+}
+
+// Carbon metric path, prefixed by check name, tags are appended using Graphite
+// tagged series format ("name;tag=value"), sorted by tag name. Units are not
+// represented on Carbon.
+func carbonMetricName(checkName string, metric Metric) string {
+	var name string = fmt.Sprintf("%s.%s", checkName, metric.Name)
+	var tags []string
+	var tag string
+
+	for tag = range metric.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	for _, tag = range tags {
+		name = fmt.Sprintf("%s;%s=%s", name, tag, metric.Tags[tag])
+	}
+
+	return strings.Replace(name, " ", "_", -1)
 }
 
 // Here on Carbon, the "serve" method will start looking at local Cache and send
 // metrics towards Carbon end-point by calling "send" method locally. Intended
-// to run in background.
+// to run in background, until stopped.
 func (cs *CarbonService) Serve() {
 	for {
-		time.Sleep(10 * time.Second)
-		cs.Send()
+		select {
+		case <-time.After(10 * time.Second):
+			cs.Send()
+		case <-cs.stopCh:
+			return
+		}
 	}
 }
 
+// Stop sending metrics, interrupting the "serve" loop.
+func (cs *CarbonService) Stop() {
+	close(cs.stopCh)
+}
+
+// Sends the metrics still pending on cache, used on shutdown after stopping
+// the "serve" loop.
+func (cs *CarbonService) Flush() error {
+	cs.logger.Infof("Flushing pending metrics.")
+	return cs.Send()
+}
+
 /* EOF */
@@ -1,19 +1,22 @@
 package godutch_test
 
 import (
+	"bufio"
+	"fmt"
 	. "github.com/otaviof/godutch"
 	gocache "github.com/patrickmn/go-cache"
 	. "github.com/smartystreets/goconvey/convey"
+	"net"
 	"testing"
 	"time"
 )
 
 func populatedCache() *gocache.Cache {
-	var metrics []map[string]int
+	var metrics Metrics
 	var cache *gocache.Cache
 	var resp *Response
 
-	metrics = append(metrics, map[string]int{"okay": 1})
+	metrics = append(metrics, Metric{Name: "okay", Value: 1})
 	cache = gocache.New(time.Minute, 20*time.Second)
 	resp = &Response{
 		Name:    "check_test",
@@ -26,17 +29,82 @@ func populatedCache() *gocache.Cache {
 	return cache
 }
 
+// Fake Carbon relay, sends the plain-text lines received on the channel.
+func mockCarbonServer(t *testing.T) (net.Listener, chan string) {
+	var err error
+	var listener net.Listener
+	var lines chan string = make(chan string, 10)
+
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var conn net.Conn
+		var scanner *bufio.Scanner
+
+		for {
+			if conn, err = listener.Accept(); err != nil {
+				return
+			}
+			scanner = bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			conn.Close()
+		}
+	}()
+
+	return listener, lines
+}
+
 func TestNewCarbonService(t *testing.T) {
 	var err error
 	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["carbonrelay"]
+	var listener net.Listener
+	var lines chan string
 	var carbonService *CarbonService
 	var cache *gocache.Cache = populatedCache()
 
-	carbonService = NewCarbonService(cfg.Service["carbonrelay"], cache)
+	listener, lines = mockCarbonServer(t)
+	defer listener.Close()
+
+	// first end-point is not listening, the second is the fake relay
+	sc.DialOn = fmt.Sprintf("127.0.0.1:1, %s", listener.Addr().String())
+	carbonService = NewCarbonService(&sc, cache)
 
 	Convey("Should be able to send metrics into Carbon", t, func() {
 		err = carbonService.Send()
 		So(err, ShouldEqual, nil)
+		So(<-lines, ShouldStartWith, "check_test.okay ")
+	})
+}
+
+func TestCarbonServiceFlushError(t *testing.T) {
+	var err error
+	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["carbonrelay"]
+	var listener net.Listener
+	var lines chan string
+	var carbonService *CarbonService
+
+	sc.DialOn = "127.0.0.1:1"
+	carbonService = NewCarbonService(&sc, populatedCache())
+
+	Convey("Should return the error when no end-point is reachable", t, func() {
+		err = carbonService.Flush()
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should send the metrics not delivered on the next attempt", t, func() {
+		listener, lines = mockCarbonServer(t)
+		defer listener.Close()
+
+		carbonService.DialOn = []string{listener.Addr().String()}
+		err = carbonService.Flush()
+		So(err, ShouldEqual, nil)
+		So(<-lines, ShouldStartWith, "check_test.okay ")
 	})
 }
 
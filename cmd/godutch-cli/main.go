@@ -1,10 +1,257 @@
-package godutch_cli
-
 //
-// godutch-cli is the command line interface for GoDutch daemon, with the
-// following roles:
-//   - control the godutch daemon, start, stop, restart;
+// godutch-cli is the command line interface for GoDutch daemon, talking to it
+// via the local control socket, with the following roles:
 //   - call for ad-hoc check execution;
-//   - load/unload containers (include and remove checks);
-//   - display the daemon statistics;
+//   - list the checks inventory, and their respective containers;
+//   - describe checks, using the metadata advertised by containers;
+//   - display the last run of each check, and the cached results;
+//   - load/unload, stop and restart containers (include and remove checks);
+//   - show the last lines written by containers on stdout and stderr;
+//   - reload the daemon configuration;
 //
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/otaviof/godutch"
+	"github.com/otaviof/gonrpe"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: godutch-cli [options] <command> [arguments]
+
+Commands:
+  execute <check> [arguments]   execute a check, exit code follows check status
+  inventory                     list checks and their containers
+  containers                    list loaded containers and their checks
+  broken                        list containers that failed to load
+  checks                        list check names
+  describe                      show checks metadata, as advertised by containers
+  cache [check...]              show cached results of checks
+  last-run                      show how long ago each check has run
+  rejected                      show NRPE connections refused by allowed_hosts
+  load <container>              load a container by configuration name
+  unload|stop <container>       unload a container by configuration name
+  restart <container>           restart a container, reloading its checks
+  logs <container>              show the last lines written by a container
+  reload                        reload configuration files
+
+Options:
+`
+
+func main() {
+	var configFilePath string
+	var socketPath string
+	var cfg *godutch.Config
+	var cc *godutch.ControlClient
+	var args []string
+	var err error
+
+	flag.StringVar(
+		&configFilePath,
+		"config-path",
+		"/etc/godutch/godutch.ini",
+		"Path to primary GoDutch configuration file.",
+	)
+
+	flag.StringVar(
+		&socketPath,
+		"socket",
+		"",
+		"Path to control socket, overwrites the configuration.",
+	)
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if args = flag.Args(); len(args) == 0 {
+		flag.Usage()
+		os.Exit(gonrpe.STATE_UNKNOWN)
+	}
+
+	// when socket path is not informed, it comes from configuration
+	if socketPath == "" {
+		if cfg, err = godutch.NewConfig(configFilePath); err != nil {
+			log.Fatalln(err)
+		}
+		socketPath = cfg.GoDutch.ControlSocket
+	}
+
+	if socketPath == "" {
+		log.Fatalln("Control socket is not configured.")
+	}
+
+	cc = godutch.NewControlClient(socketPath)
+
+	switch args[0] {
+	case "execute":
+		execute(cc, args[1:])
+	case "inventory":
+		inventory(cc)
+	case "containers":
+		containers(cc)
+	case "checks", "describe", "broken", "cache", "rejected":
+		printJSON(cc, args[0], args[1:])
+	case "last-run":
+		lastRun(cc)
+	case "reload":
+		reload(cc)
+	case "logs":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(gonrpe.STATE_UNKNOWN)
+		}
+		logs(cc, args[1])
+	case "load", "unload", "stop", "restart":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(gonrpe.STATE_UNKNOWN)
+		}
+		if err = cc.Call(args[0], args[1:], nil); err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Container '%s': %s done.\n", args[1], args[0])
+	default:
+		flag.Usage()
+		os.Exit(gonrpe.STATE_UNKNOWN)
+	}
+}
+
+// Executes a check and print it's output, exiting with check's status, like a
+// regular Nagios plugin would do.
+func execute(cc *godutch.ControlClient, args []string) {
+	var resp godutch.Response
+	var err error
+
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(gonrpe.STATE_UNKNOWN)
+	}
+
+	if err = cc.Call("execute", args, &resp); err != nil {
+		fmt.Println("[ERROR]", err)
+		os.Exit(gonrpe.STATE_UNKNOWN)
+	}
+
+	fmt.Println(strings.Join(resp.Stdout, "\n"))
+	os.Exit(resp.Status)
+}
+
+// Lists the inventory, one check per line, followed by it's container.
+func inventory(cc *godutch.ControlClient) {
+	var inventory map[string]string
+	var names []string
+	var name string
+	var err error
+
+	if err = cc.Call("inventory", []string{}, &inventory); err != nil {
+		log.Fatalln(err)
+	}
+
+	for name = range inventory {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		fmt.Printf("%-40s %s\n", name, inventory[name])
+	}
+}
+
+// Lists the loaded containers, followed by their checks.
+func containers(cc *godutch.ControlClient) {
+	var containers []godutch.ContainerInfo
+	var info godutch.ContainerInfo
+	var err error
+
+	if err = cc.Call("containers", []string{}, &containers); err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, info = range containers {
+		fmt.Printf("%-40s %s\n", info.Name, strings.Join(info.Checks, ", "))
+	}
+}
+
+// Prints the result of a command as indented JSON.
+func printJSON(cc *godutch.ControlClient, command string, args []string) {
+	var data json.RawMessage
+	var out bytes.Buffer
+	var err error
+
+	if err = cc.Call(command, args, &data); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err = json.Indent(&out, data, "", "  "); err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Println(out.String())
+}
+
+// Reloads the configuration, printing what has been changed.
+func reload(cc *godutch.ControlClient) {
+	var diff godutch.ConfigDiff
+	var err error
+
+	if err = cc.Call("reload", []string{}, &diff); err != nil {
+		log.Fatalln(err)
+	}
+
+	fmt.Printf("Configuration reloaded, %s.\n", diff.String())
+}
+
+// Prints the last lines written by a container, with timestamp and stream.
+func logs(cc *godutch.ControlClient, name string) {
+	var lines []godutch.OutputLine
+	var line godutch.OutputLine
+	var err error
+
+	if err = cc.Call("logs", []string{name}, &lines); err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, line = range lines {
+		fmt.Printf("%s [%s] %s\n", line.Ts.Format(time.RFC3339), line.Stream,
+			line.Text)
+	}
+}
+
+// Lists each check followed by the amount of seconds since it's last run.
+func lastRun(cc *godutch.ControlClient) {
+	var report map[string]int64
+	var names []string
+	var name string
+	var err error
+
+	if err = cc.Call("last-run", []string{}, &report); err != nil {
+		log.Fatalln(err)
+	}
+
+	for name = range report {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		if report[name] < 0 {
+			fmt.Printf("%-40s never\n", name)
+		} else {
+			fmt.Printf("%-40s %ds ago\n", name, report[name])
+		}
+	}
+}
+
+/* EOF */
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"github.com/otaviof/godutch"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	// exit status codes, clean shutdown or checks and metrics left behind
+	EXIT_OK               = 0
+	EXIT_SHUTDOWN_TIMEOUT = 1
+	EXIT_SHUTDOWN_ERROR   = 2
 )
 
 func main() {
@@ -13,6 +24,10 @@ func main() {
 	var enablePprof bool = false
 	var cfg *godutch.Config
 	var g *godutch.GoDutch
+	var signals chan os.Signal = make(chan os.Signal, 1)
+	var sig os.Signal
+	var logger *godutch.Logger
+	var diff *godutch.ConfigDiff
 	var err error
 
 	flag.StringVar(
@@ -39,18 +54,58 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	// from now on, logging with level and format informed on configuration
+	godutch.SetDefaultLogger(g.Logger())
+	logger = g.Logger().With("component", "Main")
+
+	// on errors, containers and services already running are stopped before
+	// exiting, so no container process is left behind
 	if err = g.LoadContainers(); err != nil {
-		log.Fatalln(err)
+		logger.Errorf("%s", err)
+		g.Stop()
+		os.Exit(1)
 	}
 
 	if err = g.LoadServices(); err != nil {
-		log.Fatalln(err)
+		logger.Errorf("%s", err)
+		g.Stop()
+		os.Exit(1)
 	}
 
 	go g.Serve()
 
 	if enablePprof {
-		http.ListenAndServe(":8080", http.DefaultServeMux)
+		go http.ListenAndServe(":8080", http.DefaultServeMux)
+	}
+
+	// configuration is reloaded on SIGHUP, and SIGTERM or SIGINT shut down
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig = range signals {
+		if sig == syscall.SIGHUP {
+			logger.Infof("SIGHUP received, reloading configuration.")
+			if diff, err = g.Reload(); err != nil {
+				logger.Errorf("Error on reloading configuration: %s", err)
+				continue
+			}
+			logger.Infof("Configuration reloaded, %s.", diff)
+			continue
+		}
+
+		logger.Infof("%s received, shutting down.", sig)
+		// a second signal interrupts the graceful shutdown right away
+		signal.Reset(syscall.SIGTERM, syscall.SIGINT)
+
+		if err = g.Shutdown(); err != nil {
+			logger.Errorf("Error on shutting down: %s", err)
+			if errors.Is(err, godutch.ErrShutdownTimeout) {
+				os.Exit(EXIT_SHUTDOWN_TIMEOUT)
+			}
+			os.Exit(EXIT_SHUTDOWN_ERROR)
+		}
+
+		logger.Infof("Shutdown complete.")
+		os.Exit(EXIT_OK)
 	}
 }
 
@@ -9,13 +9,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-ini/ini"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //
@@ -25,6 +27,8 @@ type Config struct {
 	GoDutch   GoDutchConfig
 	Service   map[string]*ServiceConfig
 	Container map[string]*ContainerConfig
+	// absolute path to primary configuration file
+	path string
 }
 
 //
@@ -33,28 +37,79 @@ type Config struct {
 //
 
 type GoDutchConfig struct {
-	UseUnixSockets bool   `ini:"use_unix_sockets"`
-	ContainersDir  string `ini:"containers_dir"`
-	ServicesDir    string `ini:"services_dir"`
-	TCPPortsRange  string `ini:"tcp_ports_range"`
+	UseUnixSockets   bool   `ini:"use_unix_sockets"`
+	ContainersDir    string `ini:"containers_dir"`
+	ServicesDir      string `ini:"services_dir"`
+	SocketsDir       string `ini:"sockets_dir"`
+	ContainerLogsDir string `ini:"container_logs_dir"`
+	WatchConfig      bool   `ini:"watch_config"`
+	WatchDebounce    int    `ini:"watch_debounce"`
+	TCPPortsRange    string `ini:"tcp_ports_range"`
+	ControlSocket    string `ini:"control_socket"`
+	SchedulerWorkers int    `ini:"scheduler_workers"`
+	LoadParallelism  int    `ini:"load_parallelism"`
+	LoadPolicy       string `ini:"load_policy"`
+	ShutdownTimeout  int    `ini:"shutdown_timeout"`
+	LogLevel         string `ini:"log_level"`
+	LogFormat        string `ini:"log_format"`
 }
 
 type ContainerConfig struct {
-	Enabled   bool     `ini:"enabled"`
-	Name      string   `ini:"name"`
-	Command   []string `ini:"command"`
-	SocketDir string   `ini:"socket_dir"`
+	Enabled          bool     `ini:"enabled"`
+	Name             string   `ini:"name"`
+	Command          []string `ini:"command"`
+	SocketDir        string   `ini:"socket_dir"`
+	LogDir           string   `ini:"log_dir"`
+	LogTail          int      `ini:"log_tail"`
+	LogMaxSize       int      `ini:"log_max_size"`
+	LogBackups       int      `ini:"log_backups"`
+	StartupTimeout   int      `ini:"startup_timeout"`
+	StopTimeout      int      `ini:"stop_timeout"`
+	Timeout          int      `ini:"timeout"`
+	CheckTimeout     []string `ini:"check_timeout"`
+	RestartOnTimeout bool     `ini:"restart_on_timeout"`
+	MaxConcurrency   int      `ini:"max_concurrency"`
+	Interval         int      `ini:"interval"`
+	CheckInterval    []string `ini:"check_interval"`
+	Jitter           int      `ini:"jitter"`
+	CheckJitter      []string `ini:"check_jitter"`
+}
+
+//
+// Differences between two configurations, in terms of enabled containers and
+// services, by name. Disabling a container or service counts as removing it.
+//
+type ConfigDiff struct {
+	ContainersAdded   []string `json:"containers_added"`
+	ContainersChanged []string `json:"containers_changed"`
+	ContainersRemoved []string `json:"containers_removed"`
+	ServicesAdded     []string `json:"services_added"`
+	ServicesChanged   []string `json:"services_changed"`
+	ServicesRemoved   []string `json:"services_removed"`
 }
 
 type ServiceConfig struct {
-	Enabled          bool   `ini:"enabled"`
-	Type             string `ini:"type"`
-	Name             string `ini:"name"`
-	Interface        string `ini:"interface"`
-	Port             int    `ini:"port"`
-	DialOn           string `ini:"dial_on"`
-	Ssl              bool   `ini:"ssl"`
-	LastRunThreshold int64  `ini:"last_run_threshold"`
+	Enabled          bool     `ini:"enabled"`
+	Type             string   `ini:"type"`
+	Name             string   `ini:"name"`
+	Interface        string   `ini:"interface"`
+	Port             int      `ini:"port"`
+	DialOn           string   `ini:"dial_on"`
+	Ssl              bool     `ini:"ssl"`
+	SslCert          string   `ini:"ssl_cert"`
+	SslKey           string   `ini:"ssl_key"`
+	SslCa            string   `ini:"ssl_ca"`
+	AllowedHosts     string   `ini:"allowed_hosts"`
+	AllowArguments   bool     `ini:"allow_arguments"`
+	ArgumentsDenied  string   `ini:"arguments_denied_chars"`
+	CheckArgsMax     []string `ini:"check_arguments_max"`
+	CheckArgsChars   []string `ini:"check_arguments_chars"`
+	CheckArgsPattern []string `ini:"check_arguments_pattern"`
+	PerfData         bool     `ini:"perfdata"`
+	LastRunThreshold int64    `ini:"last_run_threshold"`
+	HostName         string   `ini:"host_name"`
+	Encryption       int      `ini:"encryption"`
+	Password         string   `ini:"password"`
 }
 
 // Instantiate a new Config type, by loading informed configuration file and
@@ -71,7 +126,8 @@ func NewConfig(configPath string) (*Config, error) {
 
 	// checking if informed config file indeed exists
 	if _, err = exists(configPath); err != nil {
-		log.Printf("[Config] Can't find config file at: '%s'", cfgPathAbs)
+		DefaultLogger().With("component", "Config").Errorf(
+			"Can't find config file at: '%s'", cfgPathAbs)
 		return nil, err
 	}
 
@@ -80,6 +136,7 @@ func NewConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	cfg.path = cfgPathAbs
 	cfg.Service = make(map[string]*ServiceConfig)
 	cfg.Container = make(map[string]*ContainerConfig)
 
@@ -92,7 +149,8 @@ func NewConfig(configPath string) (*Config, error) {
 			filepath.Dir(cfgPathAbs),
 			dirPath,
 		); err != nil {
-			log.Println("[Config] Error on loading config file: ", err)
+			DefaultLogger().With("component", "Config").Errorf(
+				"Error on loading config file: %s", err)
 			return nil, err
 		}
 	}
@@ -100,6 +158,114 @@ func NewConfig(configPath string) (*Config, error) {
 	return cfg, nil
 }
 
+// Returns the absolute path of primary configuration file.
+func (cfg *Config) Path() string {
+	return cfg.path
+}
+
+// Returns the absolute path of services and containers directories, where INI
+// files are loaded from.
+func (cfg *Config) Dirs() []string {
+	var baseDir string = filepath.Dir(cfg.path)
+	var dirPath string
+	var dirs []string
+
+	for _, dirPath = range []string{
+		cfg.GoDutch.ServicesDir,
+		cfg.GoDutch.ContainersDir,
+	} {
+		dirPath, _ = filepath.Abs(filepath.Join(baseDir, dirPath))
+		dirs = append(dirs, dirPath)
+	}
+
+	return dirs
+}
+
+// Compares the enabled containers and services of this configuration with a new
+// one, listing what has been added, changed or removed.
+func (cfg *Config) Diff(newCfg *Config) *ConfigDiff {
+	var diff *ConfigDiff = &ConfigDiff{}
+	var oldContainers map[string]interface{} = make(map[string]interface{})
+	var newContainers map[string]interface{} = make(map[string]interface{})
+	var oldServices map[string]interface{} = make(map[string]interface{})
+	var newServices map[string]interface{} = make(map[string]interface{})
+	var name string
+
+	for name = range cfg.Container {
+		if cfg.Container[name].Enabled {
+			oldContainers[name] = *cfg.Container[name]
+		}
+	}
+	for name = range newCfg.Container {
+		if newCfg.Container[name].Enabled {
+			newContainers[name] = *newCfg.Container[name]
+		}
+	}
+	for name = range cfg.Service {
+		if cfg.Service[name].Enabled {
+			oldServices[name] = *cfg.Service[name]
+		}
+	}
+	for name = range newCfg.Service {
+		if newCfg.Service[name].Enabled {
+			newServices[name] = *newCfg.Service[name]
+		}
+	}
+
+	diff.ContainersAdded, diff.ContainersChanged, diff.ContainersRemoved =
+		diffSections(oldContainers, newContainers)
+	diff.ServicesAdded, diff.ServicesChanged, diff.ServicesRemoved =
+		diffSections(oldServices, newServices)
+
+	return diff
+}
+
+// Informs whether there are no differences at all.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.ContainersAdded)+len(d.ContainersChanged)+
+		len(d.ContainersRemoved)+len(d.ServicesAdded)+
+		len(d.ServicesChanged)+len(d.ServicesRemoved) == 0
+}
+
+// Describes the differences in a single line, for logging.
+func (d *ConfigDiff) String() string {
+	return fmt.Sprintf("containers added: %v, changed: %v, removed: %v; "+
+		"services added: %v, changed: %v, removed: %v",
+		d.ContainersAdded, d.ContainersChanged, d.ContainersRemoved,
+		d.ServicesAdded, d.ServicesChanged, d.ServicesRemoved)
+}
+
+// Compares two sets of configuration sections by name, returning the sorted
+// names that were added, changed and removed.
+func diffSections(oldSections, newSections map[string]interface{}) ([]string, []string, []string) {
+	var added []string = []string{}
+	var changed []string = []string{}
+	var removed []string = []string{}
+	var name string
+	var section interface{}
+	var found bool
+
+	for name, section = range newSections {
+		if _, found = oldSections[name]; !found {
+			added = append(added, name)
+		} else if !reflect.DeepEqual(oldSections[name], section) {
+			changed = append(changed, name)
+		}
+	}
+
+	for name = range oldSections {
+		if _, found = newSections[name]; !found {
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	return added, changed, removed
+}
+
 // Identifies absolute path for containers' directory and glob for INI files in
 // there, composing a list of INI files on that directory.
 func (cfg *Config) globIniConfigFIles(baseDir string, cfgDir string) error {
@@ -107,25 +273,26 @@ func (cfg *Config) globIniConfigFIles(baseDir string, cfgDir string) error {
 	var cfgDirAbs string
 	var glob string
 	var cfgPaths []string
+	var logger *Logger = DefaultLogger().With("component", "Config")
 
 	cfgDirAbs, _ = filepath.Abs(filepath.Join(baseDir, cfgDir))
 
 	if _, err = exists(cfgDirAbs); err != nil {
-		log.Printf("[Config] Containers dir not found at: '%s'", cfgDirAbs)
+		logger.Errorf("Containers dir not found at: '%s'", cfgDirAbs)
 		return err
 	}
 
 	// listing files on containers' config directory
 	glob = fmt.Sprintf("%s/*.ini", cfgDirAbs)
 	if cfgPaths, err = filepath.Glob(glob); err != nil {
-		log.Println("[Config] Errors on directory glob:", err)
+		logger.Errorf("Errors on directory glob: %s", err)
 		return err
 	}
 
 	// loading container configuration files
 	if len(cfgPaths) > 0 {
 		if err = cfg.loadIniConfigs(cfgPaths); err != nil {
-			log.Println("[Config] During config-file load:", err)
+			logger.Errorf("During config-file load: %s", err)
 			return err
 		}
 	}
@@ -145,18 +312,19 @@ func (cfg *Config) loadIniConfigs(cfgPaths []string) error {
 	var containerCfg *ContainerConfig
 	var name string
 	var match bool
+	var logger *Logger = DefaultLogger().With("component", "Config")
 
 	for _, cfgPath = range cfgPaths {
-		log.Printf("[Config] Loading: '%s'", cfgPath)
+		logger.Infof("Loading: '%s'", cfgPath)
 
 		// avoiding dummy files
 		if match, _ = path.Match("\\.\\#*\\.ini", path.Base(cfgPath)); match {
-			log.Printf("[Config] Ignoring config file: '%s'", cfgPath)
+			logger.Infof("Ignoring config file: '%s'", cfgPath)
 			continue
 		}
 
 		if iniCfg, err = ini.Load(cfgPath); err != nil {
-			log.Println("[Config] Config load error:", err)
+			logger.Errorf("Config load error: %s", err)
 			return err
 		}
 
@@ -169,42 +337,50 @@ func (cfg *Config) loadIniConfigs(cfgPaths []string) error {
 				serviceCfg = new(ServiceConfig)
 
 				if err = section.MapTo(serviceCfg); err != nil {
-					log.Println("[Config] Error on mapTo ServiceConfig:", err)
+					logger.Errorf("Error on mapTo ServiceConfig: %s", err)
 					return err
 				}
 
 				if name, err = sanitizeName(serviceCfg.Name); err != nil {
-					log.Println("[Config] Error on sanitize name:", err)
+					logger.Errorf("Error on sanitize name: %s", err)
 					return err
 				}
 
-				log.Printf("[Config] Adding service: '%s'", name)
+				logger.Infof("Adding service: '%s'", name)
 				serviceCfg.Name = name
 				cfg.Service[name] = serviceCfg
 
-				log.Printf("[Config] DEBUG serviceCfg: '%+v'", serviceCfg)
+				logger.Debugf("serviceCfg: '%+v'", serviceCfg)
 			case "Container":
 				containerCfg = new(ContainerConfig)
 
 				if err = section.MapTo(containerCfg); err != nil {
-					log.Println("[Config] Error on mapTo Container:", err)
+					logger.Errorf("Error on mapTo Container: %s", err)
 					return err
 				}
 
 				if name, err = sanitizeName(containerCfg.Name); err != nil {
-					log.Println("[Config] Error on sanitize name:", err)
+					logger.Errorf("Error on sanitize name: %s", err)
 					return err
 				}
 
-				log.Printf("[Config] Adding container: '%s'", name)
+				logger.Infof("Adding container: '%s'", name)
 				containerCfg.Name = name
+				// inheriting the global sockets directory, when not informed
+				if containerCfg.SocketDir == "" {
+					containerCfg.SocketDir = cfg.GoDutch.SocketsDir
+				}
+				// and the global containers log directory as well
+				if containerCfg.LogDir == "" {
+					containerCfg.LogDir = cfg.GoDutch.ContainerLogsDir
+				}
 				cfg.Container[name] = containerCfg
 
-				log.Printf("[Config] DEBUG containerCfg: '%+v'", containerCfg)
+				logger.Debugf("containerCfg: '%+v'", containerCfg)
 			case "DEFAULT":
 				continue
 			default:
-				log.Printf("[Config] Ignored section: '%s'", sectionName)
+				logger.Warnf("Ignored section: '%s'", sectionName)
 			}
 		}
 	}
@@ -218,6 +394,21 @@ func (sc *ServiceConfig) ParseDialOn() []string {
 	return strings.Split(sc.DialOn, ", ")
 }
 
+// Parses the "allowed_hosts" list of IP addresses, networks (CIDR) and host
+// names, separated by commas like on "nrpe.cfg".
+func (sc *ServiceConfig) ParseAllowedHosts() []string {
+	var hosts []string
+	var host string
+
+	for _, host = range strings.Split(sc.AllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
 func (sc *ServiceConfig) ParseDialString(dialStr string) (string, int) {
 	var str []string = strings.Split(dialStr, ":")
 	var host string = str[0]
@@ -227,6 +418,82 @@ func (sc *ServiceConfig) ParseDialString(dialStr string) (string, int) {
 	return host, portInt
 }
 
+// Returns the amount of time in-flight checks have to finish on shutdown, or
+// the default when not configured.
+func (gc *GoDutchConfig) ShutdownTimeoutOrDefault() time.Duration {
+	if gc.ShutdownTimeout > 0 {
+		return time.Duration(gc.ShutdownTimeout) * time.Second
+	}
+	return GODUTCH_DEFAULT_SHUTDOWN_TIMEOUT
+}
+
+// Returns the amount of time the container has to become ready, or the default
+// when not configured.
+func (cc *ContainerConfig) StartupTimeoutOrDefault() time.Duration {
+	if cc.StartupTimeout > 0 {
+		return time.Duration(cc.StartupTimeout) * time.Second
+	}
+	return CONTAINER_DEFAULT_STARTUP_TIMEOUT
+}
+
+// Returns the amount of time the container has to exit after SIGTERM, or the
+// default when not configured.
+func (cc *ContainerConfig) StopTimeoutOrDefault() time.Duration {
+	if cc.StopTimeout > 0 {
+		return time.Duration(cc.StopTimeout) * time.Second
+	}
+	return CONTAINER_DEFAULT_STOP_TIMEOUT
+}
+
+// Returns the maximum amount of concurrent requests towards the container, or
+// the default when not configured.
+func (cc *ContainerConfig) MaxConcurrencyOrDefault() int {
+	if cc.MaxConcurrency > 0 {
+		return cc.MaxConcurrency
+	}
+	return CONTAINER_DEFAULT_MAX_CONCURRENCY
+}
+
+// Parses a list of "name:value" entries into a map, entries which value is not
+// a integer are ignored.
+func parseNamedValues(entries []string) map[string]int {
+	var name string
+	var str string
+	var value int
+	var err error
+	var values map[string]int = make(map[string]int)
+	var logger *Logger = DefaultLogger().With("component", "Config")
+
+	for name, str = range parseNamedStrings(entries) {
+		if value, err = strconv.Atoi(str); err != nil {
+			logger.Warnf("Ignoring entry, value is not integer: '%s:%s'", name, str)
+			continue
+		}
+		values[name] = value
+	}
+
+	return values
+}
+
+// Parses a list of "name:value" entries into a map of strings, the value is
+// everything after the first colon.
+func parseNamedStrings(entries []string) map[string]string {
+	var entry string
+	var nameValue []string
+	var values map[string]string = make(map[string]string)
+	var logger *Logger = DefaultLogger().With("component", "Config")
+
+	for _, entry = range entries {
+		if nameValue = strings.SplitN(strings.TrimSpace(entry), ":", 2); len(nameValue) != 2 {
+			logger.Warnf("Ignoring entry, expected 'name:value': '%s'", entry)
+			continue
+		}
+		values[nameValue[0]] = nameValue[1]
+	}
+
+	return values
+}
+
 // Returns a sanitized name based on input raw input string. By a sanitized name
 // it means only alpha-numeric cachacters, all lower.
 func sanitizeName(rawName string) (string, error) {
@@ -266,13 +533,18 @@ func parseConfigINI(cfgPathAbs string) (*Config, error) {
 
 	// loading the INI file contents into local struct
 	if iniCfg, err = ini.Load(cfgPathAbs); err != nil {
-		log.Fatalln("[Config] Errors on parsing INI file:", err)
+		DefaultLogger().With("component", "Config").Errorf(
+			"Errors on parsing INI file: %s", err)
 		return nil, err
 	}
 
+	// UNIX sockets are used unless disabled
+	cfg.GoDutch.UseUnixSockets = true
+
 	// mapping configuration into local struct
 	if err = iniCfg.MapTo(cfg); err != nil {
-		log.Fatalln("[Config] Errors on mapping INI:", err)
+		DefaultLogger().With("component", "Config").Errorf(
+			"Errors on mapping INI: %s", err)
 		return nil, err
 	}
 
@@ -37,6 +37,12 @@ func TestNewConfig(t *testing.T) {
 		So(cfg.Service["nrpeservice"].Port, ShouldEqual, 5666)
 	})
 
+	Convey("Should be able to read check specific argument rules", t, func() {
+		So(cfg.Service["nrpeservice"].AllowArguments, ShouldBeFalse)
+		So(cfg.Service["nrpeservice"].CheckArgsPattern,
+			ShouldResemble, []string{"check_test:^-?[0-9]+$"})
+	})
+
 	Convey("Should be able to load example containers", t, func() {
 		So(len(cfg.Container), ShouldBeGreaterThan, 0)
 		So(cfg.Container["rubycontainer"].Command[0],
@@ -47,6 +53,12 @@ func TestNewConfig(t *testing.T) {
 			"bin")
 	})
 
+	Convey("Should inherit the global sockets directory", t, func() {
+		So(cfg.GoDutch.SocketsDir, ShouldEqual, "/tmp/godutch")
+		So(cfg.Container["perlcontainer"].SocketDir, ShouldEqual,
+			cfg.GoDutch.SocketsDir)
+	})
+
 	Convey("Should be able to detect NSCA configuration", t, func() {
 		So(cfg.Service["nscaservice"].Type, ShouldEqual, "nsca")
 		So(cfg.Service["nscaservice"].Port, ShouldEqual, 0)
@@ -71,4 +83,49 @@ func TestNewConfig(t *testing.T) {
 	})
 }
 
+func TestConfigDiff(t *testing.T) {
+	var oldCfg *Config = &Config{
+		Container: map[string]*ContainerConfig{
+			"kept":     {Enabled: true, Command: []string{"a", "b"}},
+			"changed":  {Enabled: true, Command: []string{"a", "b"}},
+			"removed":  {Enabled: true, Command: []string{"a", "b"}},
+			"disabled": {Enabled: true, Command: []string{"a", "b"}},
+		},
+		Service: map[string]*ServiceConfig{
+			"nrpe": {Enabled: true, Type: "nrpe", Port: 5666},
+		},
+	}
+	var newCfg *Config = &Config{
+		Container: map[string]*ContainerConfig{
+			"kept":     {Enabled: true, Command: []string{"a", "b"}},
+			"changed":  {Enabled: true, Command: []string{"a", "c"}},
+			"disabled": {Enabled: false, Command: []string{"a", "b"}},
+			"added":    {Enabled: true, Command: []string{"a", "b"}},
+		},
+		Service: map[string]*ServiceConfig{
+			"nrpe":   {Enabled: true, Type: "nrpe", Port: 5667},
+			"carbon": {Enabled: true, Type: "carbon"},
+		},
+	}
+	var diff *ConfigDiff
+
+	Convey("Should list added, changed and removed containers", t, func() {
+		diff = oldCfg.Diff(newCfg)
+		So(diff.ContainersAdded, ShouldResemble, []string{"added"})
+		So(diff.ContainersChanged, ShouldResemble, []string{"changed"})
+		So(diff.ContainersRemoved, ShouldResemble, []string{"disabled", "removed"})
+	})
+
+	Convey("Should list added, changed and removed services", t, func() {
+		So(diff.ServicesAdded, ShouldResemble, []string{"carbon"})
+		So(diff.ServicesChanged, ShouldResemble, []string{"nrpe"})
+		So(diff.ServicesRemoved, ShouldResemble, []string{})
+	})
+
+	Convey("Should find no differences on the same configuration", t, func() {
+		So(newCfg.Diff(newCfg).Empty(), ShouldBeTrue)
+		So(diff.Empty(), ShouldBeFalse)
+	})
+}
+
 /* EOF */
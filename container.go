@@ -3,11 +3,14 @@ package godutch
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"github.com/otaviof/gonrpe"
 	"github.com/thejerf/suture"
 	"io"
-	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,24 +23,65 @@ type Container struct {
 	Name         string
 	Bg           *BgCmd
 	cfg          *ContainerConfig
-	socket       net.Conn
+	transport    *Transport
+	mutex        sync.RWMutex
 	bootstrapped bool
-	Checks       []string
-	respCh       chan []byte
-	errorCh      chan error
+	// process ID the inventory was loaded from
+	pid    int
+	Checks []string
+	// metadata advertised by the container about it's checks, when supported
+	metadata map[string]CheckMetadata
+	// check specific settings, parsed once out of configuration
+	checkIntervals map[string]int
+	checkJitters   map[string]int
+	checkTimeouts  map[string]int
+	// slots for concurrent requests, each request holds a slot while running
+	slots chan struct{}
+	// amount of requests in-flight, waiting for a slot or running
+	inflight int32
+	logger   *Logger
 }
 
-// Creates a new container with a background command.
+const (
+	// default amount of time a check is allowed to run
+	CONTAINER_DEFAULT_TIMEOUT = 10 * time.Second
+	// default amount of concurrent requests towards a container
+	CONTAINER_DEFAULT_MAX_CONCURRENCY = 8
+	// amount of time a container has to describe it's checks, older agents may
+	// not answer "__describe_checks" at all
+	CONTAINER_DESCRIBE_TIMEOUT = 3 * time.Second
+	// default amount of time a container has to become ready
+	CONTAINER_DEFAULT_STARTUP_TIMEOUT = 30 * time.Second
+	// default amount of time a container has to exit after SIGTERM
+	CONTAINER_DEFAULT_STOP_TIMEOUT = 5 * time.Second
+	// first and maximum delay between readiness attempts, doubling each time
+	CONTAINER_READY_BACKOFF     = 50 * time.Millisecond
+	CONTAINER_READY_MAX_BACKOFF = 2 * time.Second
+	// amount of time a container has to answer "__ping"
+	CONTAINER_PING_TIMEOUT = time.Second
+	// how often a draining container looks for in-flight requests
+	CONTAINER_DRAIN_POLL = 50 * time.Millisecond
+)
+
+// Creates a new container with a background command, reached via UNIX socket.
 func NewContainer(cfg *ContainerConfig) (*Container, error) {
+	return NewContainerWithTransport(cfg, NewUnixTransport(cfg))
+}
+
+// Creates a new container with a background command, reached via informed
+// transport.
+func NewContainerWithTransport(cfg *ContainerConfig, t *Transport) (*Container, error) {
 	var err error
 	var c *Container
 
 	// verifying if socket directory exists
-	if _, err = exists(cfg.SocketDir); err != nil {
-		log.Fatalln(
-			"[Container] Can't find socket directory: ('",
-			cfg.SocketDir, "'):", err)
-		return nil, err
+	if t.Network == "unix" {
+		if _, err = exists(cfg.SocketDir); err != nil {
+			DefaultLogger().With("component", "Container").With(
+				"container", cfg.Name).Errorf(
+				"Can't find socket directory '%s': %s", cfg.SocketDir, err)
+			return nil, err
+		}
 	}
 
 	if len(cfg.Command) < 2 {
@@ -47,24 +91,37 @@ func NewContainer(cfg *ContainerConfig) (*Container, error) {
 	}
 
 	c = &Container{
-		Name:    cfg.Name,
-		cfg:     cfg,
-		respCh:  make(chan []byte, 1),
-		errorCh: make(chan error, 1),
+		Name:      cfg.Name,
+		cfg:       cfg,
+		transport: t,
+		slots:     make(chan struct{}, cfg.MaxConcurrencyOrDefault()),
+		metadata:  make(map[string]CheckMetadata),
+
+		checkIntervals: parseNamedValues(cfg.CheckInterval),
+		checkJitters:   parseNamedValues(cfg.CheckJitter),
+		checkTimeouts:  parseNamedValues(cfg.CheckTimeout),
 	}
+	c.SetLogger(DefaultLogger())
 
 	return c, nil
 }
 
+// Replaces the logger, entries carry the container name. Must be called before
+// the background command is created by "Client".
+func (c *Container) SetLogger(l *Logger) {
+	c.logger = l.With("component", "Container").With("container", c.Name)
+}
+
 // Creates and responds a pointer to BgCmd, which implements Suture's Service
 // interface, this will be held by the Supervisor.
 func (c *Container) Client() suture.Service {
-	log.Printf("[Container] Name: '%s', Command: '%s'",
+	c.logger.Infof("Name: '%s', Command: '%s'",
 		c.cfg.Name,
 		strings.Join(c.cfg.Command, " "))
 
 	// creating a new background command
-	c.Bg = NewBgCmd(c.cfg)
+	c.Bg = NewBgCmdWithTransport(c.cfg, c.transport)
+	c.Bg.SetLogger(c.logger)
 
 	return c.Bg
 }
@@ -72,25 +129,197 @@ func (c *Container) Client() suture.Service {
 // Returns the inventory of this container. Checks are loaded on Boostrap method
 // call.
 func (c *Container) Inventory() []string {
-	return c.Checks
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]string{}, c.Checks...)
 }
 
-// Prepare a container to be up and running, opening the socket using
-// Container's "socket" attribute.
-func (c *Container) Bootstrap() error {
-	var err error
+// Returns the metadata of a check, and whether the container has advertised it.
+// Checks without metadata are described by name only.
+func (c *Container) MetadataFor(check string) (CheckMetadata, bool) {
+	var meta CheckMetadata
+	var found bool
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if meta, found = c.metadata[check]; !found {
+		return CheckMetadata{Name: check}, false
+	}
+	return meta, true
+}
+
+// Returns the schedule of a check, operator configuration comes first: check
+// specific entries, then container configuration, and only then the interval
+// advertised by the container.
+func (c *Container) ScheduleFor(check string) CheckSchedule {
+	var meta CheckMetadata
+
+	meta, _ = c.MetadataFor(check)
+
+	return CheckSchedule{
+		Interval: firstSeconds(
+			c.checkIntervals[check], c.cfg.Interval, meta.Interval),
+		Jitter: firstSeconds(c.checkJitters[check], c.cfg.Jitter),
+	}
+}
+
+// Returns the amount of time a check is allowed to run, following the same
+// precedence as the schedule: check specific configuration, container
+// configuration, the timeout advertised by the container, then the default.
+func (c *Container) TimeoutFor(check string) time.Duration {
+	var meta CheckMetadata
+	var timeout time.Duration
+
+	meta, _ = c.MetadataFor(check)
+	if timeout = firstSeconds(
+		c.checkTimeouts[check], c.cfg.Timeout, meta.Timeout); timeout > 0 {
+		return timeout
+	}
+
+	return CONTAINER_DEFAULT_TIMEOUT
+}
+
+// Returns the longest amount of time a check of this container is allowed to
+// run, how long in-flight requests are waited for when unloading.
+func (c *Container) LongestTimeout() time.Duration {
+	var longest time.Duration = c.TimeoutFor("")
+	var timeout time.Duration
+	var check string
+
+	for _, check = range c.Inventory() {
+		if timeout = c.TimeoutFor(check); timeout > longest {
+			longest = timeout
+		}
+	}
+
+	return longest
+}
+
+// Returns the first positive amount of seconds as duration, or zero.
+func firstSeconds(values ...int) time.Duration {
+	var seconds int
+
+	for _, seconds = range values {
+		if seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	return 0
+}
 
+// Informs whether the container has been bootstrapped.
+func (c *Container) Bootstrapped() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.bootstrapped
+}
+
+// Prepare a container to be up and running, loading it's inventory.
+func (c *Container) Bootstrap() error {
+	c.mutex.Lock()
 	if c.bootstrapped {
-		log.Println("[Container] Already has been bootstraped, skipping.")
+		c.mutex.Unlock()
+		c.logger.Debugf("Already has been bootstraped, skipping.")
 		return nil
 	}
 	c.bootstrapped = true
+	c.mutex.Unlock()
+
+	c.logger.Infof("Bootstraping: '%s', Address: '%s' (%s)",
+		c.Name, c.transport.Address, c.transport.Network)
+
+	return c.LoadInventory()
+}
+
+// Loads the check's inventory, with metadata when the container supports it,
+// falling back to the plain list of check names. It's called on bootstrap, and
+// again when the background command is restarted.
+func (c *Container) LoadInventory() error {
+	var pid int
+	var err error
+
+	if c.Bg != nil {
+		pid = c.Bg.Pid()
+	}
+
+	if err = c.describeChecks(); err != nil {
+		c.logger.Infof("Can't describe checks (%s), listing them.", err)
+		if err = c.listCheckMethods(); err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	c.pid = pid
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// Returns the process ID the inventory was loaded from.
+func (c *Container) InventoryPid() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.pid
+}
+
+// Waits for the container to be ready, which is when it answers "__ping" call,
+// using exponential backoff between attempts, up to the startup timeout. The
+// answer's status is not considered, agents not aware of "__ping" are also
+// ready once they answer. Returns error when the container is never ready.
+func (c *Container) WaitReady() error {
+	var timeout time.Duration = c.cfg.StartupTimeoutOrDefault()
+	var deadline time.Time = time.Now().Add(timeout)
+	var backoff time.Duration = CONTAINER_READY_BACKOFF
+	var attempts int = 0
+	var err error
+
+	for {
+		attempts += 1
+		if err = c.ping(); err == nil {
+			c.logger.Infof("Container is ready after %d attempt(s).", attempts)
+			return nil
+		}
 
-	log.Printf("[Container] Bootstraping: '%s', Socket path: '%s'",
-		c.Name, c.Bg.SocketPath)
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("%w: '%s' after %s (%d attempts): %s",
+				ErrContainerNotReady, c.Name, timeout, attempts, err)
+		}
 
-	// loading check's inventory
-	if err = c.listCheckMethods(); err != nil {
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > CONTAINER_READY_MAX_BACKOFF {
+			backoff = CONTAINER_READY_MAX_BACKOFF
+		}
+	}
+}
+
+// Sends a "__ping" request to the container, in a single attempt, expecting a
+// valid Response back.
+func (c *Container) ping() error {
+	var req *Request
+	var conn net.Conn
+	var buf bytes.Buffer
+	var err error
+
+	if conn, err = c.transport.Dial(); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(CONTAINER_PING_TIMEOUT))
+
+	req, _ = NewRequest("__ping", []string{})
+	if _, err = conn.Write(req.ToBytes()); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(&buf, conn); err != nil {
+		return err
+	}
+
+	if _, err = NewResponse(buf.Bytes()); err != nil {
 		return err
 	}
 
@@ -98,33 +327,46 @@ func (c *Container) Bootstrap() error {
 }
 
 // Dials to a socket using a counter to support a few attempts before just
-// returning back the error.
-func (c *Container) socketDial() error {
+// returning back the error. Every request has it's own connection.
+func (c *Container) socketDial() (net.Conn, error) {
 	var err error
+	var conn net.Conn
 	var counter int = 0
 
 	for {
 		counter += 1
 		// creating a reader on background command's socket
-		if c.socket, err = net.Dial("unix", c.Bg.SocketPath); err != nil {
-			log.Println(
-				"[Container] (", counter, "/ 3 ) net.Dial error: '", err, "'")
+		if conn, err = c.transport.Dial(); err != nil {
+			c.logger.Warnf("(%d / 3) Dial error: '%s'", counter, err)
 			// maximum retries before give up
 			if counter >= 3 {
-				return err
+				return nil, err
 			} else {
 				time.Sleep(time.Second)
 				continue
 			}
 		}
-		return nil
+		return conn, nil
+	}
+}
+
+// Waits for the in-flight requests to finish, up to informed timeout. Returns
+// false when requests are still running.
+func (c *Container) Drain(timeout time.Duration) bool {
+	var deadline time.Time = time.Now().Add(timeout)
+
+	for atomic.LoadInt32(&c.inflight) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(CONTAINER_DRAIN_POLL)
 	}
+
+	return true
 }
 
-// Stop a container, closing the socket and asking os/exec to kill the process,
-// if not dead just yet.
+// Stop a container, terminating the process, if not dead just yet.
 func (c *Container) Shutdown() error {
-	defer c.socket.Close()
 	c.Bg.Stop()
 	return nil
 }
@@ -139,73 +381,182 @@ func (c *Container) listCheckMethods() error {
 	req, _ = NewRequest("__list_check_methods", []string{})
 
 	if resp, err = c.Execute(req); err != nil {
-		log.Fatalln("[Container] Socket write error:", err)
+		c.logger.Errorf("Error on listing check methods: %s", err)
 		return err
 	}
 
-	log.Printf("[Container] Checks: '%s'", strings.Join(resp.Stdout, "', '"))
+	c.logger.Infof("Checks: '%s'", strings.Join(resp.Stdout, "', '"))
+	c.mutex.Lock()
 	c.Checks = resp.Stdout
+	c.metadata = make(map[string]CheckMetadata)
+	c.mutex.Unlock()
+
+	return nil
+}
+
+// Executes the "__describe_checks" call on the socket interface, loading the
+// checks and their metadata. Returns error when the container does not support
+// the call, or when it does not describe any check.
+func (c *Container) describeChecks() error {
+	var req *Request
+	var resp *Response
+	var meta CheckMetadata
+	var checks []string
+	var metadata map[string]CheckMetadata = make(map[string]CheckMetadata)
+	var err error
+
+	req, _ = NewRequest("__describe_checks", []string{})
+
+	if resp, err = c.execute(req, CONTAINER_DESCRIBE_TIMEOUT); err != nil {
+		return err
+	}
+
+	if resp.Error != "" {
+		return fmt.Errorf("%w: %s", ErrBadResponse, resp.Error)
+	}
+
+	for _, meta = range resp.Checks {
+		if meta.Name == "" {
+			c.logger.Warnf("Ignoring check metadata without name.")
+			continue
+		}
+		checks = append(checks, meta.Name)
+		metadata[meta.Name] = meta
+	}
+
+	if len(checks) == 0 {
+		return fmt.Errorf("%w: no checks described", ErrBadResponse)
+	}
+
+	c.logger.Infof("Described checks: '%s'", strings.Join(checks, "', '"))
+	c.mutex.Lock()
+	c.Checks = checks
+	c.metadata = metadata
+	c.mutex.Unlock()
 
 	return nil
 }
 
 // Execute a request towards the socket interface, simple by syncronously
 // writing on the socket, and via a goroutine reading back from it, which must
-// be a Response type of payload.
+// be a Response type of payload. Each request uses it's own connection, and
+// holds one of the container's slots, limiting concurrency. When the container
+// does not answer within the check's timeout, a UNKNOWN Response is returned.
+// Requests without arguments use the check's default arguments, if advertised.
 func (c *Container) Execute(req *Request) (*Response, error) {
+	var meta CheckMetadata
 	var err error
+
+	meta, _ = c.MetadataFor(req.Fields.Command)
+	if len(req.Fields.Arguments) == 0 && len(meta.Arguments) > 0 {
+		if req, err = NewRequest(req.Fields.Command, meta.Arguments); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.execute(req, c.TimeoutFor(req.Fields.Command))
+}
+
+// Sends the request and waits for the response, up to the informed timeout.
+func (c *Container) execute(req *Request, timeout time.Duration) (*Response, error) {
+	var err error
+	var conn net.Conn
 	var payload []byte
 	var resp *Response
+	var respCh chan []byte = make(chan []byte, 1)
+	var errorCh chan error = make(chan error, 1)
+	var deadline <-chan time.Time = time.After(timeout)
+	var start time.Time = time.Now()
+	var logger *Logger = c.logger.With("check", req.Fields.Command)
+
+	atomic.AddInt32(&c.inflight, 1)
+	defer atomic.AddInt32(&c.inflight, -1)
+
+	// waiting for a free slot, which counts on the request's time
+	select {
+	case c.slots <- struct{}{}:
+		defer func() { <-c.slots }()
+	case <-deadline:
+		return c.timedOut(req, timeout, nil), nil
+	}
 
-	if c.socketDial(); err != nil {
-		log.Fatalln("[Container] Socket dial error:", err)
-		return nil, err
+	if conn, err = c.socketDial(); err != nil {
+		logger.Errorf("Socket dial error: %s", err)
+		return nil, fmt.Errorf("%w: %s: %s", ErrContainerDown, c.Name, err)
 	}
 
 	// to be closed when we end this func, in other words, right after reading
 	// data or handling connection error
-	defer c.socket.Close()
+	defer conn.Close()
 
-	log.Printf("[Container] Sending request: '%s'", string(req.ToBytes()[:]))
-	if _, err = c.socket.Write(req.ToBytes()); err != nil {
-		log.Println("[Container] Socket WRITE error:", err)
-		return nil, err
+	logger.Debugf("Sending request: '%s'", string(req.ToBytes()[:]))
+	if _, err = conn.Write(req.ToBytes()); err != nil {
+		logger.Errorf("Socket write error: %s", err)
+		return nil, fmt.Errorf("%w: %s: %s", ErrContainerDown, c.Name, err)
 	}
 
 	// background routine to read socke's FD, informing response and error
 	// channels when there's data back, for socket-close action we adopt defer
-	go c.socketReader()
+	go socketReader(conn, respCh, errorCh)
 
-	// TODO
-	//  * Handle request timeouts http://stackoverflow.com/questions/9680812;
-	for {
-		select {
-		case payload = <-c.respCh:
-			log.Printf("[Container] Request's payload: '%s'", string(payload[:]))
-			if resp, err = NewResponse(payload[:]); err != nil {
-				log.Fatalln("[Container] Error on parsing response:", err)
-				return nil, err
-			}
-			return resp, nil
-		case err = <-c.errorCh:
-			log.Println("[Container] Socket reading error:", err)
+	select {
+	case payload = <-respCh:
+		logger.Debugf("Request's payload: '%s'", string(payload[:]))
+		if resp, err = NewResponse(payload[:]); err != nil {
+			logger.Errorf("Error on parsing response: %s", err)
 			return nil, err
 		}
+		logger.With("status", resp.Status).With(
+			"duration", time.Since(start)).Debugf("Request answered.")
+		return resp, nil
+	case err = <-errorCh:
+		logger.Errorf("Socket reading error: %s", err)
+		return nil, fmt.Errorf("%w: %s: %s", ErrContainerDown, c.Name, err)
+	case <-deadline:
+		return c.timedOut(req, timeout, conn), nil
+	}
+}
+
+// Handles a request that has timed out, the connection is closed (if any),
+// interrupting the reader, and when configured the background command is
+// stopped, so the Supervisor restarts it. Internal calls, prefixed with "__",
+// never cause a restart. Returns a UNKNOWN Response.
+func (c *Container) timedOut(req *Request, timeout time.Duration, conn net.Conn) *Response {
+	var stdout string = fmt.Sprintf("Check '%s' timed out after %ds",
+		req.Fields.Command, int(timeout.Seconds()))
+	var logger *Logger = c.logger.With("check", req.Fields.Command)
+
+	logger.Warnf("%s", stdout)
+	if conn != nil {
+		conn.Close()
+	}
+
+	if c.cfg.RestartOnTimeout && c.Bg != nil &&
+		!strings.HasPrefix(req.Fields.Command, "__") {
+		logger.Warnf("Restarting container after timeout.")
+		// not holding the response while the process terminates
+		go c.Bg.Stop()
+	}
+
+	return &Response{
+		Name:   req.Fields.Command,
+		Status: gonrpe.STATE_UNKNOWN,
+		Stdout: []string{stdout},
+		Ts:     int32(time.Now().Unix()),
 	}
 }
 
 // Reads from a socket file descriptor onto a local buffer, which is by the end
-// sent to response-channel (respCh), informed by parameters. Error is captured
-// locally and also sent back by error-channel (errorCh).
-func (c *Container) socketReader() {
+// sent to response-channel (respCh), informed by parameters. Error is sent back
+// by error-channel (errorCh), and logged by the caller.
+func socketReader(conn net.Conn, respCh chan []byte, errorCh chan error) {
 	var err error
 	var buf bytes.Buffer
-	if _, err = io.Copy(&buf, c.socket); err != nil {
-		log.Println("[Container] Socket read error:", err)
-		c.errorCh <- err
+	if _, err = io.Copy(&buf, conn); err != nil {
+		errorCh <- err
 		return
 	}
-	c.respCh <- buf.Bytes()
+	respCh <- buf.Bytes()
 }
 
 /* EOF */
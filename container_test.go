@@ -1,9 +1,19 @@
 package godutch_test
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
 	. "github.com/otaviof/godutch"
+	"github.com/otaviof/gonrpe"
 	. "github.com/smartystreets/goconvey/convey"
+	"math/rand"
+	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -44,6 +54,38 @@ func mockBootstrappedContainer(t *testing.T, deferStop bool) *Container {
 	return c
 }
 
+// Returns a container which socket is served by informed handler, instead of
+// a background command, so it's possible to fake the container behaviour.
+func mockFakeContainer(t *testing.T, cfg *ContainerConfig, handler func(net.Conn)) (*Container, net.Listener) {
+	var err error
+	var c *Container
+	var listener net.Listener
+
+	if c, err = NewContainer(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// creating the background command only to define the socket path
+	c.Client()
+	os.Remove(c.Bg.SocketPath)
+
+	if listener, err = net.Listen("unix", c.Bg.SocketPath); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var conn net.Conn
+		for {
+			if conn, err = listener.Accept(); err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+
+	return c, listener
+}
+
 func TestNewContainer(t *testing.T) {
 	var err error
 	var containerCfg *ContainerConfig = &ContainerConfig{
@@ -78,8 +120,8 @@ func TestBootstrapAndComponentChecks(t *testing.T) {
 		req, _ = NewRequest("check_test", []string{})
 		resp, err = c.Execute(req)
 		So(err, ShouldEqual, nil)
-		So(resp.Metrics[0], ShouldContainKey, "okay")
-		So(resp.Metrics[0]["okay"], ShouldEqual, 1)
+		So(resp.Metrics[0].Name, ShouldEqual, "okay")
+		So(resp.Metrics[0].Value, ShouldEqual, 1)
 	})
 
 	Convey("Should be able to shutdown container.", t, func() {
@@ -88,4 +130,148 @@ func TestBootstrapAndComponentChecks(t *testing.T) {
 	})
 }
 
+func TestExecuteTimeout(t *testing.T) {
+	var err error
+	var c *Container
+	var listener net.Listener
+	var req *Request
+	var resp *Response
+	var start time.Time
+	var containerCfg *ContainerConfig = &ContainerConfig{
+		Name:         "TestExecuteTimeout",
+		SocketDir:    os.TempDir(),
+		Command:      []string{"sleep", "1"},
+		Timeout:      5,
+		CheckTimeout: []string{"check_hang:1"},
+	}
+
+	// fake container reads the request and never answers
+	c, listener = mockFakeContainer(t, containerCfg, func(conn net.Conn) {
+		bufio.NewReader(conn).ReadString('\n')
+		select {}
+	})
+	defer listener.Close()
+
+	Convey("Should use check specific and container timeouts", t, func() {
+		So(c.TimeoutFor("check_hang"), ShouldEqual, time.Second)
+		So(c.TimeoutFor("check_other"), ShouldEqual, 5*time.Second)
+	})
+
+	Convey("Should return UNKNOWN when the container never answers", t, func() {
+		req, _ = NewRequest("check_hang", []string{})
+		start = time.Now()
+		resp, err = c.Execute(req)
+		So(err, ShouldEqual, nil)
+		So(time.Since(start), ShouldBeLessThan, 3*time.Second)
+		So(resp.Name, ShouldEqual, "check_hang")
+		So(resp.Status, ShouldEqual, gonrpe.STATE_UNKNOWN)
+		So(resp.Stdout[0], ShouldContainSubstring, "timed out after 1s")
+	})
+}
+
+func TestExecuteConcurrently(t *testing.T) {
+	var c *Container
+	var listener net.Listener
+	var wg sync.WaitGroup
+	var mismatches int32
+	var inFlight int32
+	var peak int32
+	var i int
+	var containerCfg *ContainerConfig = &ContainerConfig{
+		Name:           "TestExecuteConcurrently",
+		SocketDir:      os.TempDir(),
+		Command:        []string{"sleep", "1"},
+		MaxConcurrency: 4,
+	}
+
+	// fake container answers with the informed argument on stdout, after a
+	// random delay, so responses are mixed up when not isolated. Requests being
+	// handled are counted, keeping the peak
+	c, listener = mockFakeContainer(t, containerCfg, func(conn net.Conn) {
+		var line string
+		var fields map[string]interface{}
+		var current int32
+		var seen int32
+
+		defer conn.Close()
+		line, _ = bufio.NewReader(conn).ReadString('\n')
+		json.Unmarshal([]byte(line), &fields)
+
+		current = atomic.AddInt32(&inFlight, 1)
+		for seen = atomic.LoadInt32(&peak); current > seen; seen = atomic.LoadInt32(&peak) {
+			if atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+		// leaving before answering, the slot is released once it's read
+		atomic.AddInt32(&inFlight, -1)
+
+		fmt.Fprintf(conn, "{\"name\":\"%s\",\"status\":0,\"stdout\":[\"%s\"]}",
+			fields["command"], fields["arguments"].([]interface{})[0])
+	})
+	defer listener.Close()
+
+	for i = 0; i < 100; i++ {
+		wg.Add(1)
+		go func(id string) {
+			var req *Request
+			var resp *Response
+			var err error
+
+			defer wg.Done()
+			req, _ = NewRequest("check_test", []string{id})
+			if resp, err = c.Execute(req); err != nil || resp.Stdout[0] != id {
+				atomic.AddInt32(&mismatches, 1)
+			}
+		}(fmt.Sprintf("request-%d", i))
+	}
+	wg.Wait()
+
+	Convey("Should isolate concurrent requests on the same container", t, func() {
+		So(atomic.LoadInt32(&mismatches), ShouldEqual, 0)
+	})
+
+	Convey("Should not exceed the maximum amount of concurrent requests", t, func() {
+		So(atomic.LoadInt32(&peak), ShouldBeLessThanOrEqualTo,
+			int32(containerCfg.MaxConcurrencyOrDefault()))
+		So(atomic.LoadInt32(&peak), ShouldBeGreaterThan, 1)
+	})
+}
+
+func TestExecuteGarbage(t *testing.T) {
+	var err error
+	var c *Container
+	var listener net.Listener
+	var req *Request
+	var resp *Response
+	var containerCfg *ContainerConfig = &ContainerConfig{
+		Name:      "TestExecuteGarbage",
+		SocketDir: os.TempDir(),
+		Command:   []string{"sleep", "1"},
+	}
+
+	// fake container answers with a payload that is not JSON
+	c, listener = mockFakeContainer(t, containerCfg, func(conn net.Conn) {
+		defer conn.Close()
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("garbage"))
+	})
+
+	req, _ = NewRequest("check_test", []string{})
+
+	Convey("Should return ErrBadResponse on garbage payload", t, func() {
+		resp, err = c.Execute(req)
+		So(resp, ShouldBeNil)
+		So(errors.Is(err, ErrBadResponse), ShouldBeTrue)
+	})
+
+	Convey("Should return ErrContainerDown when socket is gone", t, func() {
+		listener.Close()
+		resp, err = c.Execute(req)
+		So(resp, ShouldBeNil)
+		So(errors.Is(err, ErrContainerDown), ShouldBeTrue)
+	})
+}
+
 /* EOF */
@@ -0,0 +1,77 @@
+package godutch
+
+//
+// Client side of the control service, used by command line interface to talk
+// with a running GoDutch daemon.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+//
+// Control client type, holds the path to daemon's control socket.
+//
+type ControlClient struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// Creates a new control client, for the informed socket path.
+func NewControlClient(socketPath string) *ControlClient {
+	return &ControlClient{SocketPath: socketPath, Timeout: time.Minute}
+}
+
+// Sends a command with arguments towards the control service, and decode the
+// response data on informed value (when not nil). Errors reported by the daemon
+// are returned as error.
+func (cc *ControlClient) Call(command string, args []string, v interface{}) error {
+	var err error
+	var conn net.Conn
+	var req *Request
+	var reader *bufio.Reader
+	var payload []byte
+	var ctlResp ControlResponse
+
+	if req, err = NewRequest(command, args); err != nil {
+		return err
+	}
+
+	if conn, err = net.DialTimeout("unix", cc.SocketPath, cc.Timeout); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(cc.Timeout)); err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(req.ToBytes()); err != nil {
+		return err
+	}
+
+	reader = bufio.NewReader(conn)
+	if payload, err = reader.ReadBytes('\n'); err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(payload, &ctlResp); err != nil {
+		return err
+	}
+
+	if ctlResp.Error != "" {
+		return errors.New(ctlResp.Error)
+	}
+
+	if v != nil && len(ctlResp.Data) > 0 {
+		return json.Unmarshal(ctlResp.Data, v)
+	}
+
+	return nil
+}
+
+/* EOF */
@@ -0,0 +1,221 @@
+package godutch
+
+//
+// Control service is the local administrative interface of GoDutch, listening
+// on a UNIX socket and speaking newline delimited JSON, just like the protocol
+// used with the Containers. Commands are informed as Requests, and the results
+// are wrapped in a ControlResponse.
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+)
+
+const (
+	// control socket is only reachable by the owner, it's able to run checks
+	// with any arguments, and to reload, unload or restart containers
+	CONTROL_SOCKET_MODE = 0600
+)
+
+//
+// Control service type, holds the socket listener and a reference to GoDutch,
+// in order to reach Panamax and configuration.
+//
+type ControlService struct {
+	listener   net.Listener
+	g          *GoDutch
+	SocketPath string
+	logger     *Logger
+}
+
+//
+// Response for a control command, carrying the JSON representation of the
+// command's result on data, or the error message.
+//
+type ControlResponse struct {
+	Command string          `json:"command"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Creates a new control service instance, listening on informed socket path.
+func NewControlService(socketPath string, g *GoDutch) *ControlService {
+	var cs *ControlService
+	cs = &ControlService{
+		g:          g,
+		SocketPath: socketPath,
+		logger:     DefaultLogger().With("component", "Control"),
+	}
+	return cs
+}
+
+// Replaces the logger.
+func (cs *ControlService) SetLogger(l *Logger) {
+	cs.logger = l.With("component", "Control")
+}
+
+// Start listening on the UNIX socket, asyncronously will spawn a connection
+// handler, when this event happen.
+func (cs *ControlService) Serve() {
+	var err error
+	var conn net.Conn
+	var okay bool
+
+	cs.logger.Infof("Listening on: '%s'", cs.SocketPath)
+
+	// removing the socket left behind by a previous instance
+	if okay, _ = exists(cs.SocketPath); okay {
+		cs.logger.Infof("Removing old socket: '%s'", cs.SocketPath)
+		if err = os.Remove(cs.SocketPath); err != nil {
+			cs.logger.Errorf("Error on removing old socket: %s", err)
+			return
+		}
+	}
+
+	if cs.listener, err = net.Listen("unix", cs.SocketPath); err != nil {
+		cs.logger.Errorf("Error during net.Listen: %s", err)
+		return
+	}
+	if err = os.Chmod(cs.SocketPath, CONTROL_SOCKET_MODE); err != nil {
+		cs.logger.Errorf("Error on restricting socket permissions: %s", err)
+		cs.listener.Close()
+		return
+	}
+
+	for {
+		if conn, err = cs.listener.Accept(); err != nil {
+			cs.logger.Infof("Not accepting connections anymore: %s", err)
+			return
+		}
+		go cs.handleConnection(conn)
+	}
+}
+
+// Reads requests from the connection, line by line, and write back the
+// response for each of them.
+func (cs *ControlService) handleConnection(conn net.Conn) {
+	var err error
+	var scanner *bufio.Scanner = bufio.NewScanner(conn)
+	var req *Request
+	var ctlResp *ControlResponse
+	var payload []byte
+
+	defer conn.Close()
+
+	for scanner.Scan() {
+		if req, err = ParseRequest(scanner.Bytes()); err != nil {
+			ctlResp = &ControlResponse{Error: err.Error()}
+		} else {
+			ctlResp = cs.Dispatch(req)
+		}
+
+		if payload, err = json.Marshal(ctlResp); err != nil {
+			cs.logger.Errorf("Error on JSON Marshal: %s", err)
+			return
+		}
+
+		if _, err = conn.Write(append(payload, '\n')); err != nil {
+			cs.logger.Errorf("Error on writing response: %s", err)
+			return
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		cs.logger.Errorf("Error on reading from connection: %s", err)
+	}
+}
+
+// Executes the control command informed on the request, and compose a response
+// carrying the command's result.
+func (cs *ControlService) Dispatch(req *Request) *ControlResponse {
+	var err error
+	var data interface{}
+	var ctlResp *ControlResponse = &ControlResponse{Command: req.Fields.Command}
+	var args []string = req.Fields.Arguments
+
+	cs.logger.Infof("Command: '%s', arguments: '%v'", req.Fields.Command, args)
+
+	switch req.Fields.Command {
+	case "execute":
+		if len(args) < 1 {
+			err = errors.New("Check name is not informed.")
+			break
+		}
+		data, err = cs.g.Execute(args[0], args[1:])
+	case "inventory":
+		data = cs.g.p.Inventory()
+	case "containers":
+		data = cs.g.p.Containers()
+	case "broken":
+		data = cs.g.BrokenContainers()
+	case "checks":
+		data = cs.g.p.Checks()
+	case "describe":
+		data = cs.g.p.Metadata()
+	case "cache":
+		data = cs.g.CachedResponses(args)
+	case "last-run":
+		data = cs.g.p.LastRuns()
+	case "rejected":
+		data = cs.g.NrpeRejected()
+	case "load":
+		if len(args) != 1 {
+			err = errors.New("Container name is not informed.")
+			break
+		}
+		err = cs.g.LoadContainer(args[0])
+	case "unload", "stop":
+		if len(args) != 1 {
+			err = errors.New("Container name is not informed.")
+			break
+		}
+		err = cs.g.p.Unload(args[0])
+	case "logs":
+		if len(args) != 1 {
+			err = errors.New("Container name is not informed.")
+			break
+		}
+		data, err = cs.g.p.Output(args[0])
+	case "restart":
+		if len(args) != 1 {
+			err = errors.New("Container name is not informed.")
+			break
+		}
+		err = cs.g.p.Restart(args[0])
+	case "reload":
+		data, err = cs.g.Reload()
+	default:
+		err = errors.New("Unknown command: " + req.Fields.Command)
+	}
+
+	if err != nil {
+		ctlResp.Error = err.Error()
+		return ctlResp
+	}
+
+	if data != nil {
+		if ctlResp.Data, err = json.Marshal(data); err != nil {
+			ctlResp.Error = err.Error()
+		}
+	}
+
+	return ctlResp
+}
+
+// Stop the service execution, closing the socket listener, which also removes
+// the socket file.
+func (cs *ControlService) Stop() {
+	var err error
+	if cs.listener == nil {
+		return
+	}
+	if err = cs.listener.Close(); err != nil {
+		cs.logger.Errorf("Error on closing listener: %s", err)
+	}
+}
+
+/* EOF */
@@ -0,0 +1,188 @@
+package godutch_test
+
+import (
+	"fmt"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mockControlService(t *testing.T) (*ControlService, *ControlClient) {
+	var g *GoDutch = mockGoDutch(t)
+	var socketPath string = filepath.Join(
+		os.TempDir(), fmt.Sprintf("godutch-ctl-%d.sock", os.Getpid()))
+	var ctl *ControlService
+
+	ctl = NewControlService(socketPath, g)
+	go ctl.Serve()
+	time.Sleep(100 * time.Millisecond)
+
+	return ctl, NewControlClient(socketPath)
+}
+
+func TestControlService(t *testing.T) {
+	var ctl *ControlService
+	var cc *ControlClient
+	var inventory map[string]string
+	var report map[string]int64
+	var containers []ContainerInfo
+	var checks []string
+	var cached map[string]*Response
+	var info os.FileInfo
+	var rejected uint64
+	var err error
+
+	ctl, cc = mockControlService(t)
+	defer ctl.Stop()
+
+	Convey("Should only allow the owner on the socket", t, func() {
+		info, err = os.Stat(ctl.SocketPath)
+		So(err, ShouldEqual, nil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(CONTROL_SOCKET_MODE))
+	})
+
+	Convey("Should be able to list the inventory", t, func() {
+		err = cc.Call("inventory", []string{}, &inventory)
+		So(err, ShouldEqual, nil)
+		So(len(inventory), ShouldEqual, 0)
+	})
+
+	Convey("Should be able to report checks last run", t, func() {
+		err = cc.Call("last-run", []string{}, &report)
+		So(err, ShouldEqual, nil)
+		So(len(report), ShouldEqual, 0)
+	})
+
+	Convey("Should report connections rejected by NRPE", t, func() {
+		err = cc.Call("rejected", []string{}, &rejected)
+		So(err, ShouldEqual, nil)
+		So(rejected, ShouldEqual, 0)
+	})
+
+	Convey("Should be able to list containers and checks", t, func() {
+		err = cc.Call("containers", []string{}, &containers)
+		So(err, ShouldEqual, nil)
+		So(len(containers), ShouldEqual, 0)
+		err = cc.Call("checks", []string{}, &checks)
+		So(err, ShouldEqual, nil)
+		So(len(checks), ShouldEqual, 0)
+	})
+
+	Convey("Should be able to fetch cached responses", t, func() {
+		err = cc.Call("cache", []string{"check_test"}, &cached)
+		So(err, ShouldEqual, nil)
+		So(cached, ShouldNotContainKey, "check_test")
+	})
+
+	Convey("Should report errors back to the client", t, func() {
+		err = cc.Call("execute", []string{"check_dummy"}, nil)
+		So(err, ShouldNotEqual, nil)
+		err = cc.Call("load", []string{"dummycontainer"}, nil)
+		So(err.Error(), ShouldContainSubstring, "not configured")
+		err = cc.Call("unload", []string{"dummycontainer"}, nil)
+		So(err.Error(), ShouldContainSubstring, "not loaded")
+		err = cc.Call("restart", []string{"dummycontainer"}, nil)
+		So(err.Error(), ShouldContainSubstring, "not loaded")
+		err = cc.Call("dummy", []string{}, nil)
+		So(err.Error(), ShouldContainSubstring, "Unknown command")
+	})
+}
+
+func TestControlServiceContainers(t *testing.T) {
+	var baseDir string
+	var containersDir string
+	var cfg *Config
+	var g *GoDutch
+	var ctl *ControlService
+	var cc *ControlClient
+	var resp Response
+	var cached map[string]*Response
+	var checks []string
+	var containers []ContainerInfo
+	var pid int
+	var diff ConfigDiff
+	var err error
+
+	if baseDir, err = ioutil.TempDir("", "godutch-ctl"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	containersDir = filepath.Join(baseDir, "containers.d")
+	os.Mkdir(containersDir, 0700)
+	os.Mkdir(filepath.Join(baseDir, "services.d"), 0700)
+	ioutil.WriteFile(filepath.Join(baseDir, "godutch.ini"), []byte(
+		"[GoDutch]\ncontainers_dir = ./containers.d\n"+
+			"services_dir = ./services.d\n"), 0600)
+	writeHelperContainerINI(
+		t, filepath.Join(containersDir, "ctl.ini"), "ctl", "check_ctl")
+
+	Convey("Should load a helper container", t, func() {
+		cfg, err = NewConfig(filepath.Join(baseDir, "godutch.ini"))
+		So(err, ShouldEqual, nil)
+		g, err = NewGoDutch(cfg)
+		So(err, ShouldEqual, nil)
+		So(g.LoadContainers(), ShouldEqual, nil)
+	})
+	defer g.Stop()
+
+	ctl = NewControlService(filepath.Join(baseDir, "control.sock"), g)
+	go ctl.Serve()
+	defer ctl.Stop()
+	time.Sleep(100 * time.Millisecond)
+	cc = NewControlClient(ctl.SocketPath)
+
+	Convey("Should execute checks, with arguments", t, func() {
+		err = cc.Call("execute", []string{"check_ctl", "one"}, &resp)
+		So(err, ShouldEqual, nil)
+		So(resp.Name, ShouldEqual, "check_ctl")
+		So(resp.Status, ShouldEqual, 0)
+		So(resp.Stdout, ShouldResemble, []string{"helper output", "[one]"})
+	})
+
+	Convey("Should return the cached response of executed checks", t, func() {
+		err = cc.Call("cache", []string{"check_ctl"}, &cached)
+		So(err, ShouldEqual, nil)
+		So(cached, ShouldContainKey, "check_ctl")
+		So(cached["check_ctl"].Stdout[0], ShouldEqual, "helper output")
+	})
+
+	Convey("Should unload and load containers", t, func() {
+		So(cc.Call("unload", []string{"ctl"}, nil), ShouldEqual, nil)
+		So(cc.Call("checks", []string{}, &checks), ShouldEqual, nil)
+		So(len(checks), ShouldEqual, 0)
+
+		So(cc.Call("load", []string{"ctl"}, nil), ShouldEqual, nil)
+		So(cc.Call("checks", []string{}, &checks), ShouldEqual, nil)
+		So(checks, ShouldResemble, []string{"check_ctl"})
+	})
+
+	Convey("Should restart containers", t, func() {
+		So(cc.Call("containers", []string{}, &containers), ShouldEqual, nil)
+		So(len(containers), ShouldEqual, 1)
+		pid = containers[0].Pid
+
+		So(cc.Call("restart", []string{"ctl"}, nil), ShouldEqual, nil)
+		So(cc.Call("containers", []string{}, &containers), ShouldEqual, nil)
+		So(len(containers), ShouldEqual, 1)
+		So(containers[0].Pid, ShouldBeGreaterThan, 0)
+		So(containers[0].Pid, ShouldNotEqual, pid)
+	})
+
+	Convey("Should reload the configuration", t, func() {
+		writeHelperContainerINI(t, filepath.Join(containersDir, "other.ini"),
+			"other", "check_other")
+
+		err = cc.Call("reload", []string{}, &diff)
+		So(err, ShouldEqual, nil)
+		So(diff.ContainersAdded, ShouldResemble, []string{"other"})
+		So(cc.Call("checks", []string{}, &checks), ShouldEqual, nil)
+		So(checks, ShouldResemble, []string{"check_ctl", "check_other"})
+	})
+}
+
+/* EOF */
@@ -0,0 +1,70 @@
+package godutch
+
+//
+// Errors returned on request path, callers can identify them with "errors.Is"
+// and answer with a UNKNOWN Response, instead of interrupting the daemon.
+//
+
+import (
+	"errors"
+	"fmt"
+	"github.com/otaviof/gonrpe"
+	"sort"
+	"strings"
+)
+
+var (
+	// request can't be composed or parsed
+	ErrBadRequest = errors.New("bad request")
+	// container answered with a payload that is not a valid Response
+	ErrBadResponse = errors.New("bad response")
+	// check name is not part of the inventory
+	ErrCheckNotFound = errors.New("check not found")
+	// container can't be reached on it's socket
+	ErrContainerDown = errors.New("container is down")
+	// container did not answer "__ping" within it's startup timeout
+	ErrContainerNotReady = errors.New("container is not ready")
+	// arguments are disabled, or not valid for the check
+	ErrArgumentsNotAllowed = errors.New("arguments not allowed")
+	// checks were still running when shutdown timeout expired
+	ErrShutdownTimeout = errors.New("checks still running after shutdown timeout")
+	// configuration can't be reloaded once shutdown started
+	ErrShuttingDown = errors.New("shutting down")
+)
+
+//
+// Containers that failed to load, and their errors.
+//
+type LoadError struct {
+	Failed map[string]error
+}
+
+// Lists the failed containers and their errors, sorted by name.
+func (e *LoadError) Error() string {
+	var name string
+	var names []string
+	var failures []string
+
+	for name = range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		failures = append(failures, fmt.Sprintf("'%s': %s", name, e.Failed[name]))
+	}
+
+	return "failed to load containers: " + strings.Join(failures, ", ")
+}
+
+// Creates a UNKNOWN Response for a check that could not be executed, carrying
+// the error message on stdout.
+func NewErrorResponse(name string, err error) *Response {
+	return &Response{
+		Name:   name,
+		Status: gonrpe.STATE_UNKNOWN,
+		Stdout: []string{fmt.Sprintf("[ERROR] %s", err)},
+	}
+}
+
+/* EOF */
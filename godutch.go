@@ -6,8 +6,13 @@ package godutch
 //
 
 import (
+	"errors"
+	"fmt"
 	gocache "github.com/patrickmn/go-cache"
-	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -26,22 +31,73 @@ type GoDutch struct {
 	ns *NrpeService
 	// investigate cache for metrics and feed Carbon server
 	cs *CarbonService
-	// maximum threshold for running a check
+	// investigate cache for check results and submit to NSCA servers
+	nsca *NscaService
+	// investigate cache for check results and publish on Sensu
+	ss *SensuService
+	// local administrative interface, on a UNIX socket
+	ctl *ControlService
+	// runs the checks automatically, following their intervals
+	sched *Scheduler
+	// reloads configuration when INI files change
+	watcher *Watcher
+	// maximum threshold for running a check, default scheduler interval
 	lastRunThreshold int64
+	// containers that failed to load, and their errors
+	broken map[string]string
+	// guards configuration, broken containers, services, scheduler, watcher
+	// and serving flag, which reloads replace while signal and control
+	// goroutines read them
+	mutex sync.Mutex
+	// reloads are applied one at a time, and not during shutdown
+	reloadMutex sync.Mutex
+	// shutdown started, reloads are refused, guarded by reloadMutex
+	shuttingDown bool
+	// services are started as soon as they're loaded, once serving
+	serving bool
+	// levelled logger, injected on every component
+	logger *Logger
 }
 
+const (
+	// default amount of containers loaded at the same time
+	GODUTCH_DEFAULT_LOAD_PARALLELISM = 4
+	// loading policies, stop on the first broken container, or continue with
+	// the healthy ones
+	LOAD_POLICY_FAIL_FAST = "fail-fast"
+	LOAD_POLICY_CONTINUE  = "continue"
+	// default amount of time in-flight checks have to finish on shutdown
+	GODUTCH_DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
 // Instantiates a new GoDutch, which will also spawn a new Panamax.
 func NewGoDutch(cfg *Config) (*GoDutch, error) {
 	var cache *gocache.Cache
 	var p *Panamax
 	var g *GoDutch
+	var logger *Logger
 	var err error
 
+	// logging on standard error, using level and format from configuration
+	if logger, err = NewLogger(
+		os.Stderr, cfg.GoDutch.LogLevel, cfg.GoDutch.LogFormat); err != nil {
+		return nil, err
+	}
+
 	cache = gocache.New(time.Minute, 20*time.Second)
 
+	if cfg.GoDutch.UseUnixSockets && cfg.GoDutch.SocketsDir != "" {
+		if err = prepareSocketsDir(
+			cfg.GoDutch.SocketsDir, logger.With("component", "GoDutch")); err != nil {
+			return nil, err
+		}
+	}
+
 	if p, err = NewPanamax(cache); err != nil {
 		return nil, err
 	}
+	p.SetLogger(logger)
+	p.SetMaxDrain(cfg.GoDutch.ShutdownTimeoutOrDefault())
 
 	g = &GoDutch{
 		cfg:              cfg,
@@ -49,140 +105,815 @@ func NewGoDutch(cfg *Config) (*GoDutch, error) {
 		cache:            cache,
 		ns:               nil,
 		cs:               nil,
+		nsca:             nil,
+		ss:               nil,
 		lastRunThreshold: -1,
+		broken:           make(map[string]string),
+		logger:           logger.With("component", "GoDutch"),
+	}
+
+	// containers are reached via TCP when UNIX sockets are disabled
+	if !cfg.GoDutch.UseUnixSockets {
+		if err = p.UseTCPPorts(cfg.GoDutch.TCPPortsRange); err != nil {
+			return nil, err
+		}
+	}
+
+	// control service is only available when socket path is configured
+	if cfg.GoDutch.ControlSocket != "" {
+		g.ctl = NewControlService(cfg.GoDutch.ControlSocket, g)
+		g.ctl.SetLogger(logger)
 	}
 
 	return g, nil
 }
 
-// Go through the configured containers and load (unless disabled).
+// Returns the logger, components derive their own out of it.
+func (g *GoDutch) Logger() *Logger {
+	return g.logger
+}
+
+// Replaces the logger of GoDutch, Panamax and services. Containers inherit it
+// from Panamax, so it must be called before loading them.
+func (g *GoDutch) SetLogger(l *Logger) {
+	g.logger = l.With("component", "GoDutch")
+	g.p.SetLogger(l)
+	if g.ctl != nil {
+		g.ctl.SetLogger(l)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.ns != nil {
+		g.ns.SetLogger(l)
+	}
+	if g.nsca != nil {
+		g.nsca.SetLogger(l)
+	}
+	if g.cs != nil {
+		g.cs.SetLogger(l)
+	}
+	if g.ss != nil {
+		g.ss.SetLogger(l)
+	}
+}
+
+// Go through the configured containers and load (unless disabled), up to
+// "load_parallelism" containers at the same time. Following "load_policy", on
+// "fail-fast" no more containers are loaded after the first failure and error
+// is returned, while on "continue" the broken containers are only reported.
 func (g *GoDutch) LoadContainers() error {
 	var name string
+	var names []string
 	var containerCfg *ContainerConfig
-	var err error
+	var containerCfgs []*ContainerConfig
+	var failFast bool
+	var failed map[string]error
+	var loadErr *LoadError
 
-	for name, containerCfg = range g.cfg.Container {
-		log.Printf("[GoDutch] Container: '%s'", name)
+	switch g.cfg.GoDutch.LoadPolicy {
+	case "", LOAD_POLICY_FAIL_FAST:
+		failFast = true
+	case LOAD_POLICY_CONTINUE:
+		failFast = false
+	default:
+		return errors.New("[GoDutch] Unknown load policy: " +
+			g.cfg.GoDutch.LoadPolicy)
+	}
 
+	for name, containerCfg = range g.cfg.Container {
+		g.logger.With("container", name).Infof("Container: '%s'", name)
 		if !containerCfg.Enabled {
-			log.Printf("[GoDutch] Skipping, Container is disabled.")
+			g.logger.With("container", name).Infof(
+				"Skipping, Container is disabled.")
 			continue
 		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		if err = g.p.Load(containerCfg); err != nil {
-			log.Printf("[GoDutch] Error loading container '%s'", name)
-			return err
+	for _, name = range names {
+		containerCfgs = append(containerCfgs, g.cfg.Container[name])
+	}
+
+	if failed = g.loadContainers(containerCfgs, failFast); len(failed) == 0 {
+		return nil
+	}
+
+	loadErr = &LoadError{Failed: failed}
+	if failFast {
+		return loadErr
+	}
+
+	g.logger.Warnf("Continuing without broken containers, %s", loadErr)
+	return nil
+}
+
+// Loads informed containers in parallel, up to "load_parallelism" at the same
+// time, recording the broken ones. On fail-fast, no more containers are loaded
+// after the first failure, and the ones already loaded are unloaded. Returns
+// the containers that failed.
+func (g *GoDutch) loadContainers(containerCfgs []*ContainerConfig, failFast bool) map[string]error {
+	var containerCfg *ContainerConfig
+	var parallelism int = g.cfg.GoDutch.LoadParallelism
+	var slots chan struct{}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var name string
+	var loaded []string
+	var failed map[string]error = make(map[string]error)
+	var err error
+
+	if parallelism <= 0 {
+		parallelism = GODUTCH_DEFAULT_LOAD_PARALLELISM
+	}
+	slots = make(chan struct{}, parallelism)
+
+	for _, containerCfg = range containerCfgs {
+		slots <- struct{}{}
+
+		// on fail-fast, containers waiting for a slot are not loaded anymore
+		mutex.Lock()
+		if failFast && len(failed) > 0 {
+			mutex.Unlock()
+			<-slots
+			break
+		}
+		mutex.Unlock()
+
+		wg.Add(1)
+		go func(containerCfg *ContainerConfig) {
+			var err error
+
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err = g.p.Load(containerCfg)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				g.logger.With("container", containerCfg.Name).Errorf(
+					"Error loading container: %s", err)
+				failed[containerCfg.Name] = err
+				return
+			}
+			loaded = append(loaded, containerCfg.Name)
+		}(containerCfg)
+	}
+	wg.Wait()
+
+	// aborting, containers already running are not left behind
+	if failFast && len(failed) > 0 {
+		for _, name = range loaded {
+			if err = g.p.Unload(name); err != nil {
+				g.logger.With("container", name).Errorf(
+					"Error on unloading: %s", err)
+			}
 		}
 	}
 
+	g.mutex.Lock()
+	for name = range failed {
+		g.broken[name] = failed[name].Error()
+	}
+	g.mutex.Unlock()
+
+	return failed
+}
+
+// Returns the configuration in use.
+func (g *GoDutch) Config() *Config {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.cfg
+}
+
+// Lists the containers that failed to load, and their errors.
+func (g *GoDutch) BrokenContainers() map[string]string {
+	var name string
+	var broken map[string]string = make(map[string]string)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for name = range g.broken {
+		broken[name] = g.broken[name]
+	}
+
+	return broken
+}
+
+// Loads a single container by it's configuration name, regardless of being
+// disabled on configuration.
+func (g *GoDutch) LoadContainer(name string) error {
+	var containerCfg *ContainerConfig
+	var found bool
+	var err error
+
+	g.mutex.Lock()
+	containerCfg, found = g.cfg.Container[name]
+	g.mutex.Unlock()
+
+	if !found {
+		return errors.New("[GoDutch] Container is not configured: " + name)
+	}
+
+	if err = g.p.Load(containerCfg); err != nil {
+		return err
+	}
+
+	g.mutex.Lock()
+	delete(g.broken, name)
+	g.mutex.Unlock()
+
 	return nil
 }
 
+// Re-reads the configuration files, and applies the differences to running
+// containers and services. Reloads are executed one at a time, and refused with
+// ErrShuttingDown once shutdown started. Returns the differences found.
+func (g *GoDutch) Reload() (*ConfigDiff, error) {
+	var cfg *Config
+	var diff *ConfigDiff
+	var err error
+
+	g.reloadMutex.Lock()
+	defer g.reloadMutex.Unlock()
+
+	if g.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+
+	g.logger.Infof("Reloading configuration from: '%s'", g.Config().Path())
+	if cfg, err = NewConfig(g.Config().Path()); err != nil {
+		return nil, err
+	}
+
+	diff = g.Config().Diff(cfg)
+	return diff, g.Apply(cfg, diff)
+}
+
+// Applies a new configuration, following the differences informed: removed
+// containers are unloaded, added ones are loaded, and changed ones are loaded
+// again with the new configuration. Services removed are stopped, added ones
+// are started, and changed ones replaced once the new ones are ready. Unloading a container waits for it's
+// in-flight requests, and NRPE connections already accepted are answered.
+func (g *GoDutch) Apply(cfg *Config, diff *ConfigDiff) error {
+	var name string
+	var names []string
+	var containerCfgs []*ContainerConfig
+	var failed map[string]error = make(map[string]error)
+	var serving bool
+	var err error
+
+	g.logger.Infof("Applying configuration, %s", diff)
+
+	// level and format are applied right away, on every component
+	if err = g.logger.Configure(
+		cfg.GoDutch.LogLevel, cfg.GoDutch.LogFormat); err != nil {
+		g.logger.Errorf("Error on configuring logger: %s", err)
+	}
+	g.p.SetMaxDrain(cfg.GoDutch.ShutdownTimeoutOrDefault())
+
+	// containers removed or changed are unloaded first
+	names = append(names, diff.ContainersRemoved...)
+	names = append(names, diff.ContainersChanged...)
+	for _, name = range names {
+		if err = g.p.Unload(name); err != nil {
+			g.logger.With("container", name).Errorf(
+				"Error on unloading: %s", err)
+		}
+		g.mutex.Lock()
+		delete(g.broken, name)
+		g.mutex.Unlock()
+	}
+
+	// and loaded using new configuration
+	names = append([]string{}, diff.ContainersAdded...)
+	names = append(names, diff.ContainersChanged...)
+	for _, name = range names {
+		containerCfgs = append(containerCfgs, cfg.Container[name])
+	}
+	for name, err = range g.loadContainers(containerCfgs, false) {
+		failed[name] = err
+	}
+
+	// services removed are stopped, using current configuration, and changed
+	// ones are replaced once loaded, unless changing type
+	for _, name = range diff.ServicesRemoved {
+		g.stopService(g.Config().Service[name].Type)
+	}
+	for _, name = range diff.ServicesChanged {
+		if g.Config().Service[name].Type != cfg.Service[name].Type {
+			g.stopService(g.Config().Service[name].Type)
+		}
+	}
+
+	// services added or changed are started, when already serving
+	names = append([]string{}, diff.ServicesAdded...)
+	names = append(names, diff.ServicesChanged...)
+	for _, name = range names {
+		if err = g.loadService(name, cfg.Service[name]); err != nil {
+			failed[name] = err
+			continue
+		}
+		g.mutex.Lock()
+		serving = g.serving
+		g.mutex.Unlock()
+		if serving {
+			g.serveService(cfg.Service[name].Type)
+		}
+	}
+
+	g.mutex.Lock()
+	g.cfg = cfg
+	g.lastRunThreshold = g.lastRunThresholdOf(cfg)
+	// checks without their own interval follow the new threshold
+	if g.sched != nil {
+		g.sched.SetDefaultInterval(
+			time.Duration(g.lastRunThreshold) * time.Second)
+	}
+	serving = g.serving
+	g.mutex.Unlock()
+
+	// directories and "watch_config" are followed by the watcher
+	if serving {
+		g.watch(cfg)
+	}
+
+	if len(failed) > 0 {
+		return &LoadError{Failed: failed}
+	}
+
+	return nil
+}
+
+// Looks up the cached Responses of informed check names, or all of them when no
+// names are informed.
+func (g *GoDutch) CachedResponses(names []string) map[string]*Response {
+	var name string
+	var item gocache.Item
+	var cached interface{}
+	var found bool
+	var resp *Response
+	var responses map[string]*Response = make(map[string]*Response)
+
+	if len(names) == 0 {
+		for name, item = range g.cache.Items() {
+			if resp, found = item.Object.(*Response); found {
+				responses[name] = resp
+			}
+		}
+		return responses
+	}
+
+	for _, name = range names {
+		if cached, found = g.cache.Get(name); !found {
+			continue
+		}
+		if resp, found = cached.(*Response); found {
+			responses[name] = resp
+		}
+	}
+
+	return responses
+}
+
 // Loads all services listed on configuration files, skips when it's disabled
 // and had specific loading mechanisms for each service. Return error.
 func (g *GoDutch) LoadServices() error {
 	var serviceCfg *ServiceConfig
 	var name string
+	var cfg *Config
+	var err error
 
-	for name, serviceCfg = range g.cfg.Service {
-		log.Printf("[GoDutch] Service: '%s' (%s)", name, serviceCfg.Type)
+	g.mutex.Lock()
+	cfg = g.cfg
+	g.lastRunThreshold = g.lastRunThresholdOf(cfg)
+	g.mutex.Unlock()
+
+	for name, serviceCfg = range cfg.Service {
+		g.logger.With("service", name).Infof(
+			"Service: '%s' (%s)", name, serviceCfg.Type)
 
 		if !serviceCfg.Enabled {
-			log.Printf("[GoDutch] Skipping '%s' (%s), Service is disabled.",
-				name, serviceCfg.Type)
+			g.logger.With("service", name).Infof(
+				"Skipping '%s' (%s), Service is disabled.", name, serviceCfg.Type)
 			continue
 		}
 
-		log.Printf("[GoDutch] DEBUG: name: '%s', lastRunThreshold: '%d'",
-			name, serviceCfg.LastRunThreshold)
+		if err = g.loadService(name, serviceCfg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-		// when last-run-threshold is found, saving the lowest item
-		if serviceCfg.LastRunThreshold > 0 {
-			if g.lastRunThreshold == -1 || g.lastRunThreshold > serviceCfg.LastRunThreshold {
-				log.Printf("[GoDutch] LastRunThreshold: from %ds to %ds'.",
-					g.lastRunThreshold, serviceCfg.LastRunThreshold)
-				g.lastRunThreshold = serviceCfg.LastRunThreshold
-			}
+// Returns the lowest last-run-threshold of enabled services, or -1 when none of
+// them has it.
+func (g *GoDutch) lastRunThresholdOf(cfg *Config) int64 {
+	var serviceCfg *ServiceConfig
+	var threshold int64 = -1
+
+	for _, serviceCfg = range cfg.Service {
+		if !serviceCfg.Enabled || serviceCfg.LastRunThreshold <= 0 {
+			continue
+		}
+		if threshold == -1 || threshold > serviceCfg.LastRunThreshold {
+			g.logger.Debugf("LastRunThreshold: from %ds to %ds'.",
+				threshold, serviceCfg.LastRunThreshold)
+			threshold = serviceCfg.LastRunThreshold
 		}
+	}
+
+	return threshold
+}
 
-		switch serviceCfg.Type {
-		case "nrpe":
-			log.Println("[GoDutch] Loading NRPE Service")
-			// initializing NRPE service and informing local Panamax instance,
-			// then the service is able to call for checks execution
-			g.ns = NewNrpeService(serviceCfg, g.p)
-		case "nsca":
-			log.Println("[GoDutch] Loading NSCA Service")
-		case "carbon":
-			log.Println("[GoDutch] Loading Carbon Relay Service")
-			// spawning a new Carbon Relay type of service, using local cache to
-			// dispatch metrics
-			g.cs = NewCarbonService(serviceCfg, g.cache)
-		case "sensu":
-			log.Println("[GoDutch] Loading Sensu Service")
-		default:
-			panic("[GoDutch] Service type is unkown: " + serviceCfg.Type)
+// Creates a service using it's specific loading mechanism, replacing the one
+// of the same type, if any. The current service is only stopped once the new
+// one is ready, and the check results it has already sent are carried over.
+func (g *GoDutch) loadService(name string, serviceCfg *ServiceConfig) error {
+	var logger *Logger = g.logger.With("service", name)
+	var ns, oldNs *NrpeService
+	var nsca, oldNsca *NscaService
+	var cs, oldCs *CarbonService
+	var ss, oldSs *SensuService
+	var err error
+
+	switch serviceCfg.Type {
+	case "nrpe":
+		g.logger.Infof("Loading NRPE Service")
+		// initializing NRPE service and informing local Panamax instance,
+		// then the service is able to call for checks execution
+		ns = NewNrpeService(serviceCfg, g.p)
+		ns.SetLogger(logger)
+		// listening right away, a port in use fails loading the service
+		if err = g.listenNrpe(ns); err != nil {
+			g.logger.Errorf("Error on loading NRPE Service: %s", err)
+			return err
+		}
+		g.mutex.Lock()
+		oldNs, g.ns = g.ns, ns
+		g.mutex.Unlock()
+		if oldNs != nil {
+			oldNs.Stop()
+		}
+	case "nsca":
+		g.logger.Infof("Loading NSCA Service")
+		// check results on local cache are submitted as passive checks
+		if nsca, err = NewNscaService(serviceCfg, g.cache); err != nil {
+			g.logger.Errorf("Error on loading NSCA Service: %s", err)
+			return err
+		}
+		nsca.SetLogger(logger)
+		g.mutex.Lock()
+		oldNsca, g.nsca = g.nsca, nsca
+		g.mutex.Unlock()
+		if oldNsca != nil {
+			oldNsca.Stop()
+			nsca.inheritSent(oldNsca)
+		}
+	case "carbon":
+		g.logger.Infof("Loading Carbon Relay Service")
+		// spawning a new Carbon Relay type of service, using local cache to
+		// dispatch metrics
+		cs = NewCarbonService(serviceCfg, g.cache)
+		cs.SetLogger(logger)
+		g.mutex.Lock()
+		oldCs, g.cs = g.cs, cs
+		g.mutex.Unlock()
+		if oldCs != nil {
+			oldCs.Stop()
+			cs.inheritSent(oldCs)
 		}
+	case "sensu":
+		g.logger.Infof("Loading Sensu Service")
+		// check results on local cache are published as Sensu results
+		ss = NewSensuService(serviceCfg, g.cache)
+		ss.SetLogger(logger)
+		g.mutex.Lock()
+		oldSs, g.ss = g.ss, ss
+		g.mutex.Unlock()
+		if oldSs != nil {
+			oldSs.Stop()
+			ss.inheritSent(oldSs)
+		}
+	default:
+		return fmt.Errorf("[GoDutch] Service type is unkown: '%s' (%s)",
+			serviceCfg.Type, name)
 	}
 
 	return nil
 }
 
+// Opens the listener of a new NRPE service while the current one, if any, is
+// still answering. When both listen on the same address, the current one is
+// stopped first, and listens again when the new one fails.
+func (g *GoDutch) listenNrpe(ns *NrpeService) error {
+	var current *NrpeService
+	var serving bool
+	var err error
+
+	g.mutex.Lock()
+	current, serving = g.ns, g.serving
+	g.mutex.Unlock()
+
+	if current == nil || current.listenOn != ns.listenOn {
+		return ns.Listen()
+	}
+
+	current.Stop()
+	if err = ns.Listen(); err == nil {
+		return nil
+	}
+
+	g.logger.Warnf("Keeping NRPE Service on '%s'.", current.listenOn)
+	if current.Listen() == nil && serving {
+		go current.Serve()
+	}
+	return err
+}
+
+// Starts serving a service by type, in background, when it's loaded.
+func (g *GoDutch) serveService(serviceType string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	switch serviceType {
+	case "nrpe":
+		// nrpe service accepting connections
+		if g.ns != nil {
+			go g.ns.Serve()
+		}
+	case "nsca":
+		// nsca client inspecting cache and submitting check results
+		if g.nsca != nil {
+			go g.nsca.Serve()
+		}
+	case "carbon":
+		// carbon relay inpecting cache and sending metrics
+		if g.cs != nil {
+			go g.cs.Serve()
+		}
+	case "sensu":
+		// sensu publisher inspecting cache and sending check results
+		if g.ss != nil {
+			go g.ss.Serve()
+		}
+	}
+}
+
+// Stops a service by type, when it's loaded. The service is taken out under
+// lock, and stopped afterwards.
+func (g *GoDutch) stopService(serviceType string) {
+	var ns *NrpeService
+	var nsca *NscaService
+	var cs *CarbonService
+	var ss *SensuService
+
+	g.logger.Infof("Stopping '%s' service.", serviceType)
+
+	g.mutex.Lock()
+	switch serviceType {
+	case "nrpe":
+		ns, g.ns = g.ns, nil
+	case "nsca":
+		nsca, g.nsca = g.nsca, nil
+	case "carbon":
+		cs, g.cs = g.cs, nil
+	case "sensu":
+		ss, g.ss = g.ss, nil
+	}
+	g.mutex.Unlock()
+
+	if ns != nil {
+		ns.Stop()
+	}
+	if nsca != nil {
+		nsca.Stop()
+	}
+	if cs != nil {
+		cs.Stop()
+	}
+	if ss != nil {
+		ss.Stop()
+	}
+}
+
 // Wraps serve method on NRPE service.
 func (g *GoDutch) Serve() {
-	if g.ns == nil {
+	var serviceType string
+	var loaded bool
+
+	g.mutex.Lock()
+	loaded = g.ns != nil
+	g.mutex.Unlock()
+
+	if !loaded {
 		panic("NRPE Service is not loaded, nothing to Serve.")
 	}
 
-	// nrpe service accepting connections
-	go g.ns.Serve()
+	for _, serviceType = range []string{"nrpe", "carbon", "nsca", "sensu"} {
+		g.serveService(serviceType)
+	}
+	g.mutex.Lock()
+	g.serving = true
+	// running checks on schedule, last-run threshold is the default interval
+	g.sched = NewScheduler(
+		g.p,
+		g.cfg.GoDutch.SchedulerWorkers,
+		time.Duration(g.lastRunThreshold)*time.Second,
+	)
+	go g.sched.Serve()
+	g.mutex.Unlock()
+
+	// control service, local administrative interface
+	if g.ctl != nil {
+		go g.ctl.Serve()
+	}
+
+	// watching configuration directories, when enabled
+	g.watch(g.Config())
+}
+
+// Starts the configuration watcher when "watch_config" is enabled, stopping it
+// otherwise. A running watcher is replaced when directories or debounce change.
+func (g *GoDutch) watch(cfg *Config) {
+	var w *Watcher
+	var old *Watcher
+
+	if cfg.GoDutch.WatchConfig {
+		w = NewWatcher(g, time.Duration(cfg.GoDutch.WatchDebounce)*time.Second)
+	}
 
-	// carbon relay inpecting cache and sending metrics
-	go g.cs.Serve()
+	g.mutex.Lock()
+	old = g.watcher
+	if old != nil && w != nil &&
+		reflect.DeepEqual(old.dirs, w.dirs) && old.debounce == w.debounce {
+		g.mutex.Unlock()
+		return
+	}
+	g.watcher = w
+	if w != nil {
+		go w.Serve()
+	}
+	g.mutex.Unlock()
 
-	// running check's that are delayed on shedule
-	go g.runDelayedChecks()
+	if old != nil {
+		old.Stop()
+	}
+}
+
+// Amount of connections the NRPE service rejected due to "allowed_hosts", zero
+// when the service is not loaded.
+func (g *GoDutch) NrpeRejected() uint64 {
+	var ns *NrpeService
+
+	g.mutex.Lock()
+	ns = g.ns
+	g.mutex.Unlock()
+
+	if ns == nil {
+		return 0
+	}
+	return ns.Rejected()
+}
+
+// Executes a check by name with informed arguments, using Panamax routing.
+func (g *GoDutch) Execute(name string, args []string) (*Response, error) {
+	var req *Request
+	var err error
+
+	if req, err = NewRequest(name, args); err != nil {
+		return nil, err
+	}
+
+	return g.p.Execute(req)
 }
 
 // Wraps stop call for the NRPE service and Panamax objects.
 func (g *GoDutch) Stop() {
+	var ns *NrpeService
+	var watcher *Watcher
+	var sched *Scheduler
+
+	g.mutex.Lock()
+	ns, watcher, sched = g.ns, g.watcher, g.sched
+	g.mutex.Unlock()
+
 	// nrpe service stop
-	g.ns.Stop()
+	if ns != nil {
+		ns.Stop()
+	}
+	// control service stop
+	if g.ctl != nil {
+		g.ctl.Stop()
+	}
+	// configuration watcher stop
+	if watcher != nil {
+		watcher.Stop()
+	}
+	// scheduler stop
+	if sched != nil {
+		sched.Stop()
+	}
 	// panamax (and it's containers) stop
 	g.p.Stop()
 }
 
-// Using Panamax data, loop through the checks that are delayed, executing them
-// sequentially. This method is intended to run in background.
-func (g *GoDutch) runDelayedChecks() {
-	var name string
-	var lastRun int64
-	var req *Request
+// Gracefully stops GoDutch: reloads are refused, NRPE connections are no
+// longer accepted, checks are no longer scheduled, in-flight checks have until
+// the shutdown timeout to finish, pending metrics are flushed to Carbon, and
+// finally the containers are terminated and their sockets removed. Returns
+// ErrShutdownTimeout when checks were still running, or the error flushing
+// metrics.
+func (g *GoDutch) Shutdown() error {
+	var timeout time.Duration
+	var ns *NrpeService
+	var nsca *NscaService
+	var cs *CarbonService
+	var ss *SensuService
+	var watcher *Watcher
+	var sched *Scheduler
+	var flushErr error
 	var err error
 
-	if g.lastRunThreshold <= 0 {
-		log.Println("[GoDutch] lastRunThreshold is disabled, no auto-run.")
-		return
-	}
+	// a reload running is finished first, and no other is applied afterwards
+	g.reloadMutex.Lock()
+	defer g.reloadMutex.Unlock()
+	g.shuttingDown = true
 
-	log.Printf("[GoDutch] Checks will run automatically after: %ds",
-		g.lastRunThreshold)
+	g.mutex.Lock()
+	timeout = g.cfg.GoDutch.ShutdownTimeoutOrDefault()
+	ns, nsca, cs, ss = g.ns, g.nsca, g.cs, g.ss
+	watcher, sched = g.watcher, g.sched
+	g.mutex.Unlock()
 
-	for {
-		time.Sleep(10 * time.Second)
-		log.Println("[GoDutch] Sleep done, looking for delayed checks.")
+	g.logger.Infof("Shutting down, waiting up to %s for checks.", timeout)
 
-		for name, lastRun = range g.p.ChecksRunReport(g.lastRunThreshold) {
-			log.Printf("[GoDutch] Executing '%s', last run at %ds ago (%ds threshold)",
-				name, lastRun, g.lastRunThreshold)
-			if req, err = NewRequest(name, []string{}); err != nil {
-				log.Fatalln("[GoDutch] Error on creating request to: '%s'", name)
-			}
-			if _, err = g.p.Execute(req); err != nil {
-				log.Println("[GoDutch] Error on execute: ", err)
-			}
+	// no more requests coming in
+	if ns != nil {
+		ns.Stop()
+	}
+	if g.ctl != nil {
+		g.ctl.Stop()
+	}
+	if watcher != nil {
+		watcher.Stop()
+	}
+	if sched != nil {
+		sched.Stop()
+	}
+
+	// requests already running are answered
+	if !g.p.Drain(timeout) {
+		err = ErrShutdownTimeout
+	}
+
+	// metrics produced up to this point are sent
+	if cs != nil {
+		cs.Stop()
+		if flushErr = cs.Flush(); flushErr != nil && err == nil {
+			err = flushErr
 		}
 	}
+	if nsca != nil {
+		nsca.Stop()
+	}
+	if ss != nil {
+		ss.Stop()
+	}
+
+	// containers are terminated, and their sockets removed
+	g.p.Stop()
+
+	return err
+}
+
+// Creates the sockets directory, readable only by GoDutch's user, warning when
+// an existing directory is open to others.
+func prepareSocketsDir(dir string, logger *Logger) error {
+	var info os.FileInfo
+	var err error
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		logger.Errorf("Error on creating sockets directory: %s", err)
+		return err
+	}
+
+	if info, err = os.Stat(dir); err != nil {
+		return err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		logger.Warnf("Sockets directory '%s' is accessible by "+
+			"other users (%s)", dir, info.Mode().Perm())
+	}
+
+	return nil
 }
 
 /* EOF */
@@ -1,9 +1,14 @@
 package godutch_test
 
 import (
+	"errors"
 	. "github.com/otaviof/godutch"
 	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func mockGoDutch(t *testing.T) *GoDutch {
@@ -29,4 +34,252 @@ func TestLoadContainers(t *testing.T) {
 	})
 }
 
+// Creates GoDutch with helper containers, two healthy and a broken one, using
+// informed load policy.
+func mockHelperGoDutch(t *testing.T, policy string) *GoDutch {
+	var cfg *Config = &Config{
+		GoDutch: GoDutchConfig{
+			UseUnixSockets:  true,
+			LoadParallelism: 3,
+			LoadPolicy:      policy,
+		},
+		Container: map[string]*ContainerConfig{
+			"broken": mockHelperContainerConfig("broken", "+never", "check_x"),
+			"first":  mockHelperContainerConfig("first", "+slow", "check_first"),
+			"second": mockHelperContainerConfig(
+				"second", "+slow", "check_second", "check_sleep"),
+		},
+	}
+	var g *GoDutch
+	var err error
+
+	cfg.Container["broken"].StartupTimeout = 1
+
+	Convey("Should be able to instantiate GoDutch.", t, func() {
+		g, err = NewGoDutch(cfg)
+		So(err, ShouldEqual, nil)
+	})
+
+	return g
+}
+
+func TestLoadContainersContinue(t *testing.T) {
+	var g *GoDutch = mockHelperGoDutch(t, LOAD_POLICY_CONTINUE)
+	var start time.Time = time.Now()
+	var resp *Response
+	var err error
+
+	Convey("Should load healthy containers in parallel.", t, func() {
+		err = g.LoadContainers()
+		So(err, ShouldEqual, nil)
+		// loading one after the other would take at least three seconds
+		So(time.Since(start), ShouldBeLessThan, 3*time.Second)
+	})
+	defer g.Stop()
+
+	Convey("Should report the broken container.", t, func() {
+		So(len(g.BrokenContainers()), ShouldEqual, 1)
+		So(g.BrokenContainers()["broken"], ShouldContainSubstring, "not ready")
+	})
+
+	Convey("Should execute checks of healthy containers.", t, func() {
+		resp, err = g.Execute("check_second", []string{})
+		So(err, ShouldEqual, nil)
+		So(resp.Status, ShouldEqual, 0)
+	})
+}
+
+func TestLoadContainersFailFast(t *testing.T) {
+	var g *GoDutch = mockHelperGoDutch(t, LOAD_POLICY_FAIL_FAST)
+	var loadErr *LoadError
+	var err error
+
+	Convey("Should return the broken containers.", t, func() {
+		err = g.LoadContainers()
+		So(errors.As(err, &loadErr), ShouldBeTrue)
+		So(len(loadErr.Failed), ShouldEqual, 1)
+		So(errors.Is(loadErr.Failed["broken"], ErrContainerNotReady), ShouldBeTrue)
+	})
+	defer g.Stop()
+
+	Convey("Should unload the containers loaded before aborting.", t, func() {
+		_, err = g.Execute("check_first", []string{})
+		So(errors.Is(err, ErrCheckNotFound), ShouldBeTrue)
+		_, err = os.Stat(filepath.Join(os.TempDir(), "godutch-first.sock"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
+
+func TestLoadContainersUnknownPolicy(t *testing.T) {
+	var g *GoDutch = mockHelperGoDutch(t, "whatever")
+
+	Convey("Should refuse unknown load policies.", t, func() {
+		So(g.LoadContainers(), ShouldNotEqual, nil)
+	})
+}
+
+func TestApply(t *testing.T) {
+	var g *GoDutch = mockHelperGoDutch(t, LOAD_POLICY_CONTINUE)
+	var cfg *Config
+	var second ContainerConfig
+	var diff *ConfigDiff
+	var resp *Response
+	var execErr error
+	var done chan struct{} = make(chan struct{})
+	var conn net.Conn
+	var taken net.Listener
+	var takenCfg *Config
+	var loadErr *LoadError
+	var err error
+
+	Convey("Should load containers and services.", t, func() {
+		g.Config().Service = map[string]*ServiceConfig{
+			"nrpe": {Enabled: true, Type: "nrpe", Interface: "127.0.0.1", Port: 15777},
+		}
+		So(g.LoadContainers(), ShouldEqual, nil)
+		So(g.LoadServices(), ShouldEqual, nil)
+		g.Serve()
+	})
+	defer g.Stop()
+
+	// a check is running on "second", while it's disabled
+	second = *g.Config().Container["second"]
+	second.Enabled = false
+
+	cfg = &Config{
+		GoDutch: g.Config().GoDutch,
+		Container: map[string]*ContainerConfig{
+			"first":  mockHelperContainerConfig("first", "check_first", "check_other"),
+			"second": &second,
+			"third":  mockHelperContainerConfig("third", "check_third"),
+		},
+		Service: map[string]*ServiceConfig{
+			"nrpe": {Enabled: true, Type: "nrpe", Interface: "127.0.0.1", Port: 15778},
+		},
+	}
+
+	go func() {
+		resp, execErr = g.Execute("check_sleep", []string{})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	Convey("Should apply the differences between configurations.", t, func() {
+		diff = g.Config().Diff(cfg)
+		So(diff.ContainersAdded, ShouldResemble, []string{"third"})
+		So(diff.ContainersChanged, ShouldResemble, []string{"first"})
+		So(diff.ContainersRemoved, ShouldResemble, []string{"broken", "second"})
+		So(diff.ServicesChanged, ShouldResemble, []string{"nrpe"})
+
+		err = g.Apply(cfg, diff)
+		So(err, ShouldEqual, nil)
+		So(g.BrokenContainers(), ShouldResemble, map[string]string{})
+	})
+
+	Convey("Should answer the check running while unloading.", t, func() {
+		<-done
+		So(execErr, ShouldEqual, nil)
+		So(resp.Status, ShouldEqual, 0)
+	})
+
+	Convey("Should execute checks of added and changed containers.", t, func() {
+		_, err = g.Execute("check_other", []string{})
+		So(err, ShouldEqual, nil)
+		_, err = g.Execute("check_third", []string{})
+		So(err, ShouldEqual, nil)
+		_, err = g.Execute("check_second", []string{})
+		So(errors.Is(err, ErrCheckNotFound), ShouldBeTrue)
+	})
+
+	Convey("Should listen on NRPE's new port.", t, func() {
+		time.Sleep(100 * time.Millisecond)
+		conn, err = net.Dial("tcp", "127.0.0.1:15778")
+		So(err, ShouldEqual, nil)
+		conn.Close()
+		_, err = net.Dial("tcp", "127.0.0.1:15777")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should report a NRPE port already in use, and carry on.", t, func() {
+		taken, err = net.Listen("tcp", "127.0.0.1:15779")
+		So(err, ShouldEqual, nil)
+		defer taken.Close()
+
+		takenCfg = &Config{
+			GoDutch:   cfg.GoDutch,
+			Container: cfg.Container,
+			Service: map[string]*ServiceConfig{
+				"nrpe": {Enabled: true, Type: "nrpe", Interface: "127.0.0.1", Port: 15779},
+			},
+		}
+		err = g.Apply(takenCfg, g.Config().Diff(takenCfg))
+		So(errors.As(err, &loadErr), ShouldBeTrue)
+		So(loadErr.Failed, ShouldContainKey, "nrpe")
+
+		_, err = g.Execute("check_third", []string{})
+		So(err, ShouldEqual, nil)
+
+		// the service in use keeps listening
+		conn, err = net.Dial("tcp", "127.0.0.1:15778")
+		So(err, ShouldEqual, nil)
+		conn.Close()
+	})
+
+	Convey("Should replace NRPE listening on the same port.", t, func() {
+		takenCfg = &Config{
+			GoDutch:   cfg.GoDutch,
+			Container: cfg.Container,
+			Service: map[string]*ServiceConfig{
+				"nrpe": {Enabled: true, Type: "nrpe", Interface: "127.0.0.1",
+					Port: 15778, AllowedHosts: "127.0.0.1"},
+			},
+		}
+		err = g.Apply(takenCfg, g.Config().Diff(takenCfg))
+		So(err, ShouldEqual, nil)
+
+		time.Sleep(100 * time.Millisecond)
+		conn, err = net.Dial("tcp", "127.0.0.1:15778")
+		So(err, ShouldEqual, nil)
+		conn.Close()
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	var g *GoDutch = mockHelperGoDutch(t, LOAD_POLICY_CONTINUE)
+	var finished chan struct{} = make(chan struct{})
+	var socketPath string = filepath.Join(os.TempDir(), "godutch-second.sock")
+	var resp *Response
+	var execErr error
+	var err error
+
+	Convey("Should load containers.", t, func() {
+		So(g.LoadContainers(), ShouldEqual, nil)
+	})
+
+	go func() {
+		resp, execErr = g.Execute("check_sleep", []string{})
+		close(finished)
+	}()
+	// making sure the check is running
+	time.Sleep(200 * time.Millisecond)
+
+	Convey("Should wait for in-flight checks on shutdown.", t, func() {
+		err = g.Shutdown()
+		So(err, ShouldEqual, nil)
+		So(waitClosed(finished, time.Second), ShouldBeTrue)
+		So(execErr, ShouldEqual, nil)
+		So(resp.Stdout[0], ShouldEqual, "helper output")
+	})
+
+	Convey("Should remove container sockets.", t, func() {
+		_, err = os.Stat(socketPath)
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Should refuse reloading after shutdown.", t, func() {
+		_, err = g.Reload()
+		So(errors.Is(err, ErrShuttingDown), ShouldBeTrue)
+	})
+}
+
 /* EOF */
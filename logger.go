@@ -0,0 +1,313 @@
+package godutch
+
+//
+// Logger writes levelled entries with structured fields, like the container,
+// check or service involved, formatted as plain text, logfmt or JSON, so they
+// can be shipped to log aggregators. Loggers derived with "With" share the
+// output and level of their parent.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Severity of a log entry, entries below the logger level are discarded.
+//
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+const (
+	// output formats, plain text is meant for humans
+	LOG_FORMAT_TEXT   = "text"
+	LOG_FORMAT_LOGFMT = "logfmt"
+	LOG_FORMAT_JSON   = "json"
+	// defaults, when not informed on configuration
+	LOG_DEFAULT_LEVEL  = "info"
+	LOG_DEFAULT_FORMAT = LOG_FORMAT_TEXT
+)
+
+var logLevelNames = map[LogLevel]string{
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+}
+
+//
+// Logger type, holds the shared output and the fields added to every entry.
+//
+type Logger struct {
+	output *logOutput
+	fields []logField
+}
+
+//
+// Where entries are written to and how, shared between derived loggers.
+//
+type logOutput struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	format string
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logger used by components created without an injected logger
+var defaultLogger *Logger = &Logger{output: &logOutput{
+	writer: os.Stderr,
+	level:  LOG_INFO,
+	format: LOG_FORMAT_TEXT,
+}}
+var defaultLoggerMutex sync.RWMutex
+
+// Creates a new logger writing on informed writer, using level and format
+// names, empty strings select the defaults.
+func NewLogger(writer io.Writer, level string, format string) (*Logger, error) {
+	var l *Logger = &Logger{output: &logOutput{writer: writer}}
+	var err error
+
+	if err = l.Configure(level, format); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Returns the logger used by components without an injected logger.
+func DefaultLogger() *Logger {
+	defaultLoggerMutex.RLock()
+	defer defaultLoggerMutex.RUnlock()
+	return defaultLogger
+}
+
+// Replaces the logger used by components without an injected logger, affects
+// only components created afterwards.
+func SetDefaultLogger(l *Logger) {
+	defaultLoggerMutex.Lock()
+	defer defaultLoggerMutex.Unlock()
+	defaultLogger = l
+}
+
+// Parses a level name, like "debug" or "warn".
+func ParseLogLevel(name string) (LogLevel, error) {
+	var level LogLevel
+	var levelName string
+
+	if name == "" {
+		name = LOG_DEFAULT_LEVEL
+	}
+
+	for level, levelName = range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+
+	return LOG_INFO, fmt.Errorf("Invalid log level: '%s'", name)
+}
+
+// Name of the level.
+func (level LogLevel) String() string {
+	return logLevelNames[level]
+}
+
+// Changes level and format of the logger, and of every logger sharing it's
+// output, empty strings select the defaults.
+func (l *Logger) Configure(level string, format string) error {
+	var logLevel LogLevel
+	var err error
+
+	if logLevel, err = ParseLogLevel(level); err != nil {
+		return err
+	}
+
+	switch format {
+	case "":
+		format = LOG_DEFAULT_FORMAT
+	case LOG_FORMAT_TEXT, LOG_FORMAT_LOGFMT, LOG_FORMAT_JSON:
+	default:
+		return fmt.Errorf("Invalid log format: '%s'", format)
+	}
+
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	l.output.level = logLevel
+	l.output.format = format
+
+	return nil
+}
+
+// Returns a logger sharing the same output, with an additional field on every
+// entry. A field with the same key is replaced.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	var fields []logField = make([]logField, 0, len(l.fields)+1)
+	var field logField
+
+	for _, field = range l.fields {
+		if field.key != key {
+			fields = append(fields, field)
+		}
+	}
+	fields = append(fields, logField{key: key, value: value})
+
+	return &Logger{output: l.output, fields: fields}
+}
+
+// Returns true when entries of informed level are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+	return level >= l.output.level
+}
+
+// Writes a debug entry, noisy details useful when troubleshooting.
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LOG_DEBUG, format, args...)
+}
+
+// Writes an info entry.
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LOG_INFO, format, args...)
+}
+
+// Writes a warning entry, something is off but GoDutch carries on.
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LOG_WARN, format, args...)
+}
+
+// Writes an error entry.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LOG_ERROR, format, args...)
+}
+
+// Formats and writes an entry, when the level is enabled.
+func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	var now time.Time = time.Now()
+	var msg string = fmt.Sprintf(format, args...)
+	var buf bytes.Buffer
+
+	l.output.mutex.Lock()
+	defer l.output.mutex.Unlock()
+
+	if level < l.output.level {
+		return
+	}
+
+	switch l.output.format {
+	case LOG_FORMAT_JSON:
+		l.formatJSON(&buf, now, level, msg)
+	case LOG_FORMAT_LOGFMT:
+		l.formatLogfmt(&buf, now, level, msg)
+	default:
+		l.formatText(&buf, now, level, msg)
+	}
+	buf.WriteByte('\n')
+
+	l.output.writer.Write(buf.Bytes())
+}
+
+// Plain text, similar to the standard logger, component between brackets and
+// the other fields after the message.
+func (l *Logger) formatText(buf *bytes.Buffer, now time.Time, level LogLevel, msg string) {
+	var field logField
+
+	fmt.Fprintf(buf, "%s %-5s ", now.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(level.String()))
+
+	for _, field = range l.fields {
+		if field.key == "component" {
+			fmt.Fprintf(buf, "[%v] ", field.value)
+		}
+	}
+	buf.WriteString(msg)
+
+	for _, field = range l.fields {
+		if field.key != "component" {
+			fmt.Fprintf(buf, " %s=%s", field.key, logfmtValue(field.value))
+		}
+	}
+}
+
+// Key-value pairs, values are quoted when needed.
+func (l *Logger) formatLogfmt(buf *bytes.Buffer, now time.Time, level LogLevel, msg string) {
+	var field logField
+
+	fmt.Fprintf(buf, "time=%s level=%s msg=%s", now.Format(time.RFC3339),
+		level, logfmtValue(msg))
+
+	for _, field = range l.fields {
+		fmt.Fprintf(buf, " %s=%s", field.key, logfmtValue(field.value))
+	}
+}
+
+// A JSON object per line, keeping the order of fields.
+func (l *Logger) formatJSON(buf *bytes.Buffer, now time.Time, level LogLevel, msg string) {
+	var field logField
+
+	buf.WriteString("{")
+	writeJSONField(buf, "time", now.Format(time.RFC3339))
+	buf.WriteString(",")
+	writeJSONField(buf, "level", level.String())
+	buf.WriteString(",")
+	writeJSONField(buf, "msg", msg)
+
+	for _, field = range l.fields {
+		buf.WriteString(",")
+		writeJSONField(buf, field.key, field.value)
+	}
+	buf.WriteString("}")
+}
+
+// Writes a JSON key and value, values like durations and errors are written
+// as their string representation.
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	var payload []byte
+	var err error
+
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+
+	if payload, err = json.Marshal(value); err != nil {
+		payload, _ = json.Marshal(fmt.Sprint(value))
+	}
+
+	buf.WriteString(strconv.Quote(key))
+	buf.WriteString(":")
+	buf.Write(payload)
+}
+
+// Formats a value for logfmt, quoting when empty or when it has spaces, quotes
+// or equal signs.
+func logfmtValue(value interface{}) string {
+	var str string = fmt.Sprint(value)
+
+	if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+/* EOF */
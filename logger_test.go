@@ -0,0 +1,104 @@
+package godutch_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var err error
+
+	Convey("Should refuse unknown levels and formats.", t, func() {
+		_, err = NewLogger(&buf, "verbose", "")
+		So(err, ShouldNotEqual, nil)
+		_, err = NewLogger(&buf, "", "xml")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should use defaults when level and format are empty.", t, func() {
+		_, err = NewLogger(&buf, "", "")
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	var logger *Logger
+	var err error
+
+	Convey("Should discard entries below the level.", t, func() {
+		logger, err = NewLogger(&buf, "WARN", LOG_FORMAT_TEXT)
+		So(err, ShouldEqual, nil)
+		So(logger.Enabled(LOG_INFO), ShouldBeFalse)
+		So(logger.Enabled(LOG_ERROR), ShouldBeTrue)
+
+		logger.Debugf("debug entry")
+		logger.Infof("info entry")
+		logger.Warnf("warn entry")
+		logger.Errorf("error entry")
+
+		So(buf.String(), ShouldNotContainSubstring, "debug entry")
+		So(buf.String(), ShouldNotContainSubstring, "info entry")
+		So(buf.String(), ShouldContainSubstring, "WARN  warn entry")
+		So(buf.String(), ShouldContainSubstring, "ERROR error entry")
+	})
+
+	Convey("Should change the level of derived loggers.", t, func() {
+		buf.Reset()
+		So(logger.Configure("debug", LOG_FORMAT_TEXT), ShouldEqual, nil)
+		logger.With("component", "Test").Debugf("debug entry")
+		So(buf.String(), ShouldContainSubstring, "DEBUG [Test] debug entry")
+	})
+}
+
+func TestLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	var logger *Logger
+	var entry map[string]interface{}
+	var err error
+
+	logger, _ = NewLogger(&buf, "info", LOG_FORMAT_TEXT)
+	logger = logger.With("component", "Test").With("check", "check_test")
+
+	Convey("Should write plain text, with component between brackets.", t, func() {
+		buf.Reset()
+		logger.With("duration", 1500*time.Millisecond).Infof("Executed")
+		So(buf.String(), ShouldEndWith,
+			"INFO  [Test] Executed check=check_test duration=1.5s\n")
+	})
+
+	Convey("Should write logfmt, quoting values when needed.", t, func() {
+		buf.Reset()
+		So(logger.Configure("info", LOG_FORMAT_LOGFMT), ShouldEqual, nil)
+		logger.With("check", "check test").Infof("Check executed")
+		So(buf.String(), ShouldStartWith, "time=")
+		So(buf.String(), ShouldEndWith, " level=info msg=\"Check executed\" "+
+			"component=Test check=\"check test\"\n")
+	})
+
+	Convey("Should write JSON, a object per line.", t, func() {
+		buf.Reset()
+		So(logger.Configure("info", LOG_FORMAT_JSON), ShouldEqual, nil)
+		logger.With("status", 2).With("error", errors.New("failed")).Errorf(
+			"Check '%s' failed", "check_test")
+		So(strings.Count(buf.String(), "\n"), ShouldEqual, 1)
+
+		err = json.Unmarshal(buf.Bytes(), &entry)
+		So(err, ShouldEqual, nil)
+		So(entry["level"], ShouldEqual, "error")
+		So(entry["msg"], ShouldEqual, "Check 'check_test' failed")
+		So(entry["component"], ShouldEqual, "Test")
+		So(entry["check"], ShouldEqual, "check_test")
+		So(entry["status"], ShouldEqual, 2)
+		So(entry["error"], ShouldEqual, "failed")
+	})
+}
+
+/* EOF */
@@ -6,20 +6,32 @@ package godutch
 //
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/otaviof/gonrpe"
-	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //
 // NRPE service type, basically holds configuration.
 //
 type NrpeService struct {
+	mutex    sync.Mutex
 	listener net.Listener
 	cfg      *ServiceConfig
 	p        *Panamax
 	listenOn string
+	// networks allowed to connect, nil when any host is allowed
+	allowed []*net.IPNet
+	// amount of connections rejected by "allowed_hosts"
+	rejected uint64
+	// decides whether arguments informed by callers reach the checks
+	argPolicy *ArgumentPolicy
+	logger    *Logger
 }
 
 // Creates a new instance of NRPE serice, which recieves a pointer of Panamax,
@@ -27,36 +39,180 @@ type NrpeService struct {
 func NewNrpeService(cfg *ServiceConfig, p *Panamax) *NrpeService {
 	var ns *NrpeService
 	ns = &NrpeService{
-		cfg:      cfg,
-		p:        p,
-		listenOn: fmt.Sprintf("%s:%d", cfg.Interface, cfg.Port),
+		cfg:       cfg,
+		p:         p,
+		listenOn:  fmt.Sprintf("%s:%d", cfg.Interface, cfg.Port),
+		argPolicy: NewArgumentPolicy(cfg),
+		logger:    DefaultLogger().With("component", "Nrpe"),
 	}
 	return ns
 }
 
-// Start listening on network interface and port, asyncronously will spawn a
-// connection handler, when this event happen.
+// Replaces the logger.
+func (ns *NrpeService) SetLogger(l *Logger) {
+	ns.logger = l.With("component", "Nrpe")
+}
+
+// Opens the network listener on configured interface and port, wrapped in TLS
+// when "ssl" is enabled, and resolves "allowed_hosts". Called when the service
+// is loaded, so errors like a port already in use, invalid certificates or
+// allowed hosts that can't be resolved, are reported to the caller instead of
+// interrupting the daemon.
+func (ns *NrpeService) Listen() error {
+	var err error
+	var listener net.Listener
+	var tlsCfg *tls.Config
+	var allowed []*net.IPNet
+
+	// host names on "allowed_hosts" are resolved once, when loading
+	if allowed, err = ns.resolveAllowedHosts(); err != nil {
+		ns.logger.Errorf("Error on allowed hosts: %s", err)
+		return err
+	}
+
+	if ns.cfg.Ssl {
+		if tlsCfg, err = ns.cfg.TLSConfig(); err != nil {
+			ns.logger.Errorf("Error on TLS configuration: %s", err)
+			return err
+		}
+	}
+
+	if listener, err = net.Listen("tcp", ns.listenOn); err != nil {
+		ns.logger.Errorf("Error during net.Listen: %s", err)
+		return err
+	}
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	ns.mutex.Lock()
+	ns.listener = listener
+	ns.allowed = allowed
+	ns.mutex.Unlock()
+
+	return nil
+}
+
+// Accepts connections on the listener, opening it when not yet listening, and
+// asyncronously spawns a connection handler for each of them.
 func (ns *NrpeService) Serve() {
 	var err error
 	var conn net.Conn
+	var listener net.Listener
 
-	log.Printf("[Nrpe] Listening on: '%s'", ns.listenOn)
+	ns.mutex.Lock()
+	listener = ns.listener
+	ns.mutex.Unlock()
 
-	// creates a new network listener based on configuration
-	if ns.listener, err = net.Listen("tcp", ns.listenOn); err != nil {
-		log.Fatalln("[Nrpe] Error during net.Listen:", err)
-		return
+	if listener == nil {
+		if err = ns.Listen(); err != nil {
+			return
+		}
+		ns.mutex.Lock()
+		listener = ns.listener
+		ns.mutex.Unlock()
 	}
 
+	ns.logger.With("ssl", ns.cfg.Ssl).Infof("Listening on: '%s'", ns.listenOn)
+
 	for {
-		if conn, err = ns.listener.Accept(); err != nil {
-			log.Println("[Nrpe] Error on accepting connection:", err)
+		if conn, err = listener.Accept(); err != nil {
+			ns.logger.Infof("Not accepting connections anymore: %s", err)
 			return
 		}
+
+		if !ns.isAllowed(conn.RemoteAddr()) {
+			atomic.AddUint64(&ns.rejected, 1)
+			ns.logger.With("remote", conn.RemoteAddr().String()).Warnf(
+				"Connection rejected, host is not allowed.")
+			conn.Close()
+			continue
+		}
+
 		go ns.handleConnection(conn)
 	}
 }
 
+// Transforms "allowed_hosts" entries into networks, host names are resolved and
+// each of their addresses is allowed. Returns error on entries that can't be
+// parsed or resolved, and nil when the option is not informed.
+func (ns *NrpeService) resolveAllowedHosts() ([]*net.IPNet, error) {
+	var hosts []string = ns.cfg.ParseAllowedHosts()
+	var allowed []*net.IPNet
+	var host string
+	var ipNet *net.IPNet
+	var ip net.IP
+	var ips []net.IP
+	var err error
+
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	allowed = []*net.IPNet{}
+	for _, host = range hosts {
+		if strings.Contains(host, "/") {
+			if _, ipNet, err = net.ParseCIDR(host); err != nil {
+				return nil, fmt.Errorf("Invalid network on allowed hosts: '%s'", host)
+			}
+			allowed = append(allowed, ipNet)
+			continue
+		}
+
+		if ip = net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if ips, err = net.LookupIP(host); err != nil {
+			return nil, fmt.Errorf("Can't resolve allowed host '%s': %s", host, err)
+		}
+
+		for _, ip = range ips {
+			if ip.To4() != nil {
+				ip = ip.To4()
+			}
+			allowed = append(allowed, &net.IPNet{
+				IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		}
+	}
+
+	ns.logger.Debugf("Allowed hosts: '%v'", allowed)
+
+	return allowed, nil
+}
+
+// Checks whether the remote address is allowed to connect.
+func (ns *NrpeService) isAllowed(addr net.Addr) bool {
+	var tcpAddr *net.TCPAddr
+	var ipNet *net.IPNet
+	var allowed []*net.IPNet
+	var ok bool
+
+	ns.mutex.Lock()
+	allowed = ns.allowed
+	ns.mutex.Unlock()
+
+	if allowed == nil {
+		return true
+	}
+
+	if tcpAddr, ok = addr.(*net.TCPAddr); !ok {
+		return false
+	}
+
+	for _, ipNet = range allowed {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Amount of connections rejected since the service started, due to
+// "allowed_hosts".
+func (ns *NrpeService) Rejected() uint64 {
+	return atomic.LoadUint64(&ns.rejected)
+}
+
 // Takes a network connection and extract it's buffer, passing along to create
 // a NrpePacket, from which we can extract the actual command and it's
 // arguments.
@@ -64,47 +220,65 @@ func (ns *NrpeService) handleConnection(conn net.Conn) {
 	var err error
 	var n int
 	var buf []byte = make([]byte, gonrpe.NRPE_PACKET_SIZE)
-	var pkt *gonrpe.NrpePacket
 	var cmd string
-	var args []string = []string{}
+	var args []string
 	var resp *Response
+	var start time.Time = time.Now()
+	var logger *Logger = ns.logger.With("remote", conn.RemoteAddr().String())
+
+	defer func() {
+		if err = conn.Close(); err != nil {
+			logger.Warnf("Error on closing connection: %s", err)
+		}
+	}()
 
 	if n, err = conn.Read(buf); n == 0 || err != nil {
-		log.Println("[Nrpe] Error on reading from connection:", err)
+		logger.Errorf("Error on reading from connection: %v", err)
 		return
 	}
 
-	// transforming payload on a NRPE packet
-	if pkt, err = gonrpe.NewNrpePacket(buf, n); err != nil {
-		log.Println("[Nrpe] Payload:", string(buf[:]))
-		log.Fatalln("[Nrpe] Error on response NRPE Packet:", err)
-		return
+	// using buffer to exectract command and it's argument, errors on the
+	// packet or execution are informed back as UNKNOWN
+	if cmd, args, err = ns.extractCmdAndArgs(buf, n); err != nil {
+		logger.Errorf("Error on NRPE packet: %s", err)
+		resp = NewErrorResponse(cmd, err)
+	} else if err = ns.argPolicy.Validate(cmd, args); err != nil {
+		logger.With("check", cmd).Warnf("Arguments refused: %s", err)
+		resp = NewErrorResponse(cmd, err)
+	} else if resp, err = ns.panamaxExecute(cmd, args); err != nil {
+		logger.With("check", cmd).Errorf("Error on GODUTCH-EXEC: %s", err)
+		resp = NewErrorResponse(cmd, err)
+	} else if ns.cfg.PerfData {
+		resp = resp.WithPerfData()
 	}
 
-	if cmd, args, err = pkt.ExtractCmdAndArgsFromBuffer(); err != nil {
-		log.Fatalln("[Nrpe] Error on parsing packet's buffer:", err)
+	// writing back to the connection
+	if _, err = conn.Write(gonrpe.NrpePacketFromResponse(resp)); err != nil {
+		logger.Errorf("Error on writing response: %s", err)
 		return
 	}
 
-	// using buffer to exectract command and it's argument
-	if resp, err = ns.panamaxExecute(cmd, args); err != nil {
-		log.Println("[Nrpe] Error on GODUTCH-EXEC:", err)
-		resp = &Response{
-			Name:   cmd,
-			Status: gonrpe.STATE_UNKNOWN,
-			Stdout: []string{fmt.Sprintf("[ERROR] %s", err)},
-		}
-	}
+	logger.With("check", cmd).With("status", resp.Status).With(
+		"duration", time.Since(start)).Infof("Request answered.")
+}
 
-	// writing back to the connection
-	if _, err = conn.Write(gonrpe.NrpePacketFromResponse(resp)); err != nil {
-		log.Fatalln("[Nrpe] Error on writing response:", err)
-		return
+// Transforms the payload on a NRPE packet, and extract command and arguments
+// from it. Errors are reported as ErrBadRequest.
+func (ns *NrpeService) extractCmdAndArgs(buf []byte, n int) (string, []string, error) {
+	var err error
+	var pkt *gonrpe.NrpePacket
+	var cmd string
+	var args []string
+
+	if pkt, err = gonrpe.NewNrpePacket(buf, n); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrBadRequest, err)
 	}
 
-	if err = conn.Close(); err != nil {
-		log.Println("[Nrpe] Error on closing connection:", err)
+	if cmd, args, err = pkt.ExtractCmdAndArgsFromBuffer(); err != nil {
+		return "", nil, fmt.Errorf("%w: %s", ErrBadRequest, err)
 	}
+
+	return cmd, args, nil
 }
 
 // Extract command and arguments from the packet buffer and compose a call
@@ -126,12 +300,20 @@ func (ns *NrpeService) panamaxExecute(cmd string, args []string) (*Response, err
 }
 
 // Stop the service execution, which here for NRPE service means closing the
-// network listener.
+// network listener. Connections already accepted are still answered.
 func (ns *NrpeService) Stop() {
 	var err error
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	if ns.listener == nil {
+		return
+	}
 	if err = ns.listener.Close(); err != nil {
-		log.Println("[Nrpe] Error on closing listener:", err)
+		ns.logger.Errorf("Error on closing listener: %s", err)
 	}
+	ns.listener = nil
 }
 
 /* EOF */
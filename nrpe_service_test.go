@@ -1,11 +1,16 @@
 package godutch_test
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	. "github.com/otaviof/godutch"
 	"github.com/otaviof/gonrpe"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -41,4 +46,199 @@ func TestNewNrpeService(t *testing.T) {
 	})
 }
 
+func TestNrpeServiceBadPacket(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var sc *ServiceConfig = &ServiceConfig{Interface: "127.0.0.1", Port: 15666}
+	var ns *NrpeService = NewNrpeService(sc, p)
+	var conn net.Conn
+	var buf []byte = make([]byte, gonrpe.NRPE_PACKET_SIZE)
+	var err error
+
+	go ns.Serve()
+	defer ns.Stop()
+	time.Sleep(1e9)
+
+	Convey("Should answer a malformed packet and keep serving", t, func() {
+		conn, err = net.Dial("tcp", "127.0.0.1:15666")
+		So(err, ShouldEqual, nil)
+		_, err = conn.Write([]byte("garbage"))
+		So(err, ShouldEqual, nil)
+		_, err = io.ReadFull(conn, buf)
+		So(err, ShouldEqual, nil)
+		conn.Close()
+
+		conn, err = net.Dial("tcp", "127.0.0.1:15666")
+		So(err, ShouldEqual, nil)
+		conn.Close()
+	})
+}
+
+// Sends a sample NRPE packet over TLS and reads the response packet.
+func nrpeOverTLS(address string, tlsCfg *tls.Config) error {
+	var conn *tls.Conn
+	var buf []byte = make([]byte, gonrpe.NRPE_PACKET_SIZE)
+	var err error
+
+	if conn, err = tls.Dial("tcp", address, tlsCfg); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(gonrpe.SAMPLE_PACKET_NRPE_PAYLOAD); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, buf)
+
+	return err
+}
+
+func TestNrpeServiceTLS(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var sc *ServiceConfig = &ServiceConfig{
+		Interface: "127.0.0.1", Port: 15667, Ssl: true}
+	var ns *NrpeService = NewNrpeService(sc, p)
+	var err error
+
+	go ns.Serve()
+	defer ns.Stop()
+	time.Sleep(1e9)
+
+	Convey("Should answer over TLS with an ephemeral certificate", t, func() {
+		err = nrpeOverTLS("127.0.0.1:15667", &tls.Config{InsecureSkipVerify: true})
+		So(err, ShouldEqual, nil)
+	})
+
+	Convey("Should not be verified by clients, being self-signed", t, func() {
+		err = nrpeOverTLS("127.0.0.1:15667", &tls.Config{})
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestNrpeServiceMutualTLS(t *testing.T) {
+	var pki *mockPKI = mockNewPKI(t)
+	var p *Panamax = mockPanamax(t)
+	var sc *ServiceConfig = &ServiceConfig{
+		Interface: "127.0.0.1",
+		Port:      15668,
+		Ssl:       true,
+		SslCert:   pki.serverCert,
+		SslKey:    pki.serverKey,
+		SslCa:     pki.caCert,
+	}
+	var ns *NrpeService = NewNrpeService(sc, p)
+	var roots *x509.CertPool = x509.NewCertPool()
+	var clientCert tls.Certificate
+	var caPEM []byte
+	var err error
+
+	defer os.RemoveAll(pki.dir)
+
+	caPEM, _ = ioutil.ReadFile(pki.caCert)
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, _ = tls.LoadX509KeyPair(pki.clientCert, pki.clientKey)
+
+	go ns.Serve()
+	defer ns.Stop()
+	time.Sleep(1e9)
+
+	Convey("Should answer clients presenting a certificate signed by CA", t, func() {
+		err = nrpeOverTLS("127.0.0.1:15668", &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: []tls.Certificate{clientCert},
+		})
+		So(err, ShouldEqual, nil)
+	})
+
+	Convey("Should refuse clients without certificate", t, func() {
+		err = nrpeOverTLS("127.0.0.1:15668", &tls.Config{
+			RootCAs:    roots,
+			ServerName: "localhost",
+		})
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestNrpeServiceBadCertificate(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var sc *ServiceConfig = &ServiceConfig{
+		Interface: "127.0.0.1",
+		Port:      15671,
+		Ssl:       true,
+		SslCert:   "/non/existing/server.crt",
+		SslKey:    "/non/existing/server.key",
+	}
+	var ns *NrpeService = NewNrpeService(sc, p)
+	var err error
+
+	Convey("Should report invalid certificates, without listening", t, func() {
+		err = ns.Listen()
+		So(err, ShouldNotEqual, nil)
+		_, err = net.Dial("tcp", "127.0.0.1:15671")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should return from Serve, instead of exiting", t, func() {
+		ns.Serve()
+		_, err = net.Dial("tcp", "127.0.0.1:15671")
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+func TestNrpeServiceAllowedHosts(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var sc *ServiceConfig
+	var ns *NrpeService
+	var conn net.Conn
+	var buf []byte = make([]byte, gonrpe.NRPE_PACKET_SIZE)
+	var err error
+
+	Convey("Should answer hosts on allowed list, by address or name", t, func() {
+		sc = &ServiceConfig{Interface: "127.0.0.1", Port: 15669,
+			AllowedHosts: "192.0.2.1, localhost"}
+		ns = NewNrpeService(sc, p)
+		go ns.Serve()
+		time.Sleep(1e9)
+
+		conn, err = net.Dial("tcp", "127.0.0.1:15669")
+		So(err, ShouldEqual, nil)
+		_, err = conn.Write(gonrpe.SAMPLE_PACKET_NRPE_PAYLOAD)
+		So(err, ShouldEqual, nil)
+		_, err = io.ReadFull(conn, buf)
+		So(err, ShouldEqual, nil)
+		conn.Close()
+		So(ns.Rejected(), ShouldEqual, 0)
+
+		ns.Stop()
+	})
+
+	Convey("Should reject and count hosts outside allowed networks", t, func() {
+		sc = &ServiceConfig{Interface: "127.0.0.1", Port: 15670,
+			AllowedHosts: "192.0.2.0/24,::1/128"}
+		ns = NewNrpeService(sc, p)
+		go ns.Serve()
+		time.Sleep(1e9)
+
+		conn, err = net.Dial("tcp", "127.0.0.1:15670")
+		So(err, ShouldEqual, nil)
+		_, err = io.ReadFull(conn, buf)
+		So(err, ShouldNotEqual, nil)
+		conn.Close()
+		So(ns.Rejected(), ShouldEqual, 1)
+
+		ns.Stop()
+	})
+
+	Convey("Should refuse loading with hosts that can't be resolved", t, func() {
+		sc = &ServiceConfig{Interface: "127.0.0.1", Port: 15672,
+			AllowedHosts: "127.0.0.1, godutch.invalid"}
+		ns = NewNrpeService(sc, p)
+		err = ns.Listen()
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, "godutch.invalid")
+		_, err = net.Dial("tcp", "127.0.0.1:15672")
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
 /* EOF */
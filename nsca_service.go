@@ -0,0 +1,270 @@
+package godutch
+
+//
+// Implements a NSCA (Nagios Service Check Acceptor) client, which submits the
+// check results found on local cache towards Nagios as passive checks. The
+// NSCA wire protocol is implemented here: the server greets the client with
+// an init packet, carrying the IV and timestamp, followed by the client data
+// packets, with CRC32 and optional encryption.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	gocache "github.com/patrickmn/go-cache"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// size of the initialization vector sent by the server
+	NSCA_IV_SIZE = 128
+	// init packet is composed by IV and a 32 bit timestamp
+	NSCA_INIT_PACKET_SIZE = NSCA_IV_SIZE + 4
+	// data packet version 3, the only one accepted by NSCA 2.x servers
+	NSCA_PACKET_VERSION = 3
+	// data packet size, with C struct alignment padding included
+	NSCA_DATA_PACKET_SIZE = 720
+	// maximum lengths of packet's strings, including trailing NULL byte
+	NSCA_MAX_HOSTNAME_LENGTH     = 64
+	NSCA_MAX_DESCRIPTION_LENGTH  = 128
+	NSCA_MAX_PLUGINOUTPUT_LENGTH = 512
+	// supported encryption methods
+	NSCA_ENCRYPT_NONE = 0
+	NSCA_ENCRYPT_XOR  = 1
+	// timeout for network operations
+	NSCA_TIMEOUT = 10 * time.Second
+)
+
+// offsets of data packet fields, following the C struct layout
+const (
+	nscaOffsetVersion     = 0
+	nscaOffsetCrc32       = 4
+	nscaOffsetTimestamp   = 8
+	nscaOffsetReturnCode  = 12
+	nscaOffsetHostName    = 14
+	nscaOffsetDescription = nscaOffsetHostName + NSCA_MAX_HOSTNAME_LENGTH
+	nscaOffsetOutput      = nscaOffsetDescription + NSCA_MAX_DESCRIPTION_LENGTH
+)
+
+type NscaService struct {
+	cfg   *ServiceConfig
+	cache *gocache.Cache
+	// mapping the responses that are already submitted with their respective
+	// timestamp, to avoid duplication
+	sentResult map[string]int32
+	hostName   string
+	DialOn     []string
+	stopCh     chan struct{}
+	// results are sent by one caller at a time
+	mutex  sync.Mutex
+	logger *Logger
+}
+
+// Creates a new instance of NscaService, which takes a cache object to look for
+// check responses. When host name is not informed on configuration, the local
+// one is used instead.
+func NewNscaService(cfg *ServiceConfig, cache *gocache.Cache) (*NscaService, error) {
+	var err error
+	var ns *NscaService
+
+	if cfg.Encryption != NSCA_ENCRYPT_NONE && cfg.Encryption != NSCA_ENCRYPT_XOR {
+		err = fmt.Errorf("[Nsca] Encryption method not supported: '%d'",
+			cfg.Encryption)
+		return nil, err
+	}
+
+	ns = &NscaService{
+		cfg:        cfg,
+		cache:      cache,
+		sentResult: make(map[string]int32),
+		hostName:   cfg.HostName,
+		DialOn:     cfg.ParseDialOn(),
+		stopCh:     make(chan struct{}),
+		logger:     DefaultLogger().With("component", "Nsca"),
+	}
+
+	if ns.hostName == "" {
+		if ns.hostName, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ns, nil
+}
+
+// Replaces the logger.
+func (ns *NscaService) SetLogger(l *Logger) {
+	ns.logger = l.With("component", "Nsca")
+}
+
+// Takes over the results already sent by the service being replaced, so they
+// are not submitted again.
+func (ns *NscaService) inheritSent(old *NscaService) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	copySent(ns.sentResult, old.sentResult)
+}
+
+// Submits the pending check results to NSCA server, using the configured
+// end-points sequentially, until one of them accepts the results.
+func (ns *NscaService) Send() error {
+	var err error
+	var pending map[string]*Response
+	var dialStr string
+	var name string
+	var resp *Response
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	if pending = pendingResponses(ns.cache, ns.sentResult, ns.logger); len(pending) == 0 {
+		ns.logger.Debugf("No check results to be sent, skipping.")
+		return nil
+	}
+
+	for _, dialStr = range ns.DialOn {
+		ns.logger.Infof("Submitting '%d' result(s) towards '%s'",
+			len(pending), dialStr)
+
+		if err = ns.submit(dialStr, pending); err != nil {
+			ns.logger.Errorf("Error on submitting to '%s': %s", dialStr, err)
+			continue
+		}
+
+		// results are delivered, marking them as sent
+		for name, resp = range pending {
+			ns.sentResult[name] = resp.Ts
+		}
+
+		ns.logger.Infof("Check results sent!")
+		return nil
+	}
+
+	if err == nil {
+		err = errors.New("[Nsca] No end-points to dial on.")
+	}
+	ns.logger.Errorf("No more hosts to try.")
+
+	// last know error is being returned, although, more erros might have been
+	// written to the logs
+	return err
+}
+
+// Opens a connection towards a NSCA server, reads the init packet and then
+// writes a data packet per check result.
+func (ns *NscaService) submit(dialStr string, pending map[string]*Response) error {
+	var err error
+	var conn net.Conn
+	var init []byte = make([]byte, NSCA_INIT_PACKET_SIZE)
+	var iv []byte
+	var ts uint32
+	var resp *Response
+
+	if conn, err = net.DialTimeout("tcp", dialStr, NSCA_TIMEOUT); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(NSCA_TIMEOUT)); err != nil {
+		return err
+	}
+
+	// server greets with IV and it's own timestamp, which is used on packets
+	if _, err = io.ReadFull(conn, init); err != nil {
+		return err
+	}
+	iv = init[:NSCA_IV_SIZE]
+	ts = binary.BigEndian.Uint32(init[NSCA_IV_SIZE:])
+
+	for _, resp = range pending {
+		if _, err = conn.Write(ns.Packet(resp, iv, ts)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Composes a NSCA data packet for a given Response, using init packet's IV and
+// timestamp, and encrypted with configured method.
+func (ns *NscaService) Packet(resp *Response, iv []byte, ts uint32) []byte {
+	var pkt []byte = make([]byte, NSCA_DATA_PACKET_SIZE)
+	var output string = strings.Join(resp.Stdout, "\\n")
+
+	binary.BigEndian.PutUint16(pkt[nscaOffsetVersion:], NSCA_PACKET_VERSION)
+	binary.BigEndian.PutUint32(pkt[nscaOffsetTimestamp:], ts)
+	binary.BigEndian.PutUint16(pkt[nscaOffsetReturnCode:], uint16(resp.Status))
+
+	// strings are truncated to leave room for the trailing NULL byte
+	copyCString(pkt[nscaOffsetHostName:], ns.hostName,
+		NSCA_MAX_HOSTNAME_LENGTH)
+	copyCString(pkt[nscaOffsetDescription:], resp.Name,
+		NSCA_MAX_DESCRIPTION_LENGTH)
+	copyCString(pkt[nscaOffsetOutput:], output,
+		NSCA_MAX_PLUGINOUTPUT_LENGTH)
+
+	// checksum is calculated with it's own field zeroed
+	binary.BigEndian.PutUint32(pkt[nscaOffsetCrc32:], crc32.ChecksumIEEE(pkt))
+
+	return ns.encrypt(pkt, iv)
+}
+
+// Encrypts the packet in place, according to the configured method. XOR will
+// use both the IV and the password, when informed.
+func (ns *NscaService) encrypt(pkt []byte, iv []byte) []byte {
+	var i int
+	var password []byte = []byte(ns.cfg.Password)
+
+	if ns.cfg.Encryption != NSCA_ENCRYPT_XOR {
+		return pkt
+	}
+
+	for i = range pkt {
+		pkt[i] ^= iv[i%len(iv)]
+	}
+
+	if len(password) > 0 {
+		for i = range pkt {
+			pkt[i] ^= password[i%len(password)]
+		}
+	}
+
+	return pkt
+}
+
+// Here on NSCA, the "serve" method looks at local cache periodically and submit
+// the check results by calling "send" method locally. Intended to run in
+// background, until stopped.
+func (ns *NscaService) Serve() {
+	for {
+		select {
+		case <-time.After(10 * time.Second):
+			ns.Send()
+		case <-ns.stopCh:
+			return
+		}
+	}
+}
+
+// Stop submitting check results, interrupting the "serve" loop.
+func (ns *NscaService) Stop() {
+	close(ns.stopCh)
+}
+
+// Copies a string onto a fixed size buffer, always leaving the last byte to be
+// a NULL terminator.
+func copyCString(dst []byte, str string, size int) {
+	if len(str) > size-1 {
+		str = str[:size-1]
+	}
+	copy(dst[:size-1], str)
+}
+
+/* EOF */
@@ -0,0 +1,148 @@
+package godutch_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Fake NSCA server, greets each client with a init packet using informed IV
+// and timestamp, and then sends the data packets received on the channel.
+func mockNscaServer(t *testing.T, iv []byte, ts uint32) (net.Listener, chan []byte) {
+	var err error
+	var listener net.Listener
+	var packets chan []byte = make(chan []byte, 10)
+
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var conn net.Conn
+
+		for {
+			if conn, err = listener.Accept(); err != nil {
+				return
+			}
+			go mockNscaConnection(conn, iv, ts, packets)
+		}
+	}()
+
+	return listener, packets
+}
+
+// Greets a client of the fake NSCA server, and reads it's data packets.
+func mockNscaConnection(conn net.Conn, iv []byte, ts uint32, packets chan []byte) {
+	var init []byte = make([]byte, NSCA_INIT_PACKET_SIZE)
+	var pkt []byte
+
+	defer conn.Close()
+
+	copy(init, iv)
+	binary.BigEndian.PutUint32(init[NSCA_IV_SIZE:], ts)
+	conn.Write(init)
+
+	for {
+		pkt = make([]byte, NSCA_DATA_PACKET_SIZE)
+		if _, err := io.ReadFull(conn, pkt); err != nil {
+			return
+		}
+		packets <- pkt
+	}
+}
+
+// Builds the expected data packet, following the C struct layout of NSCA's
+// "data_packet_struct", encrypted with XOR using IV and password.
+func expectedNscaPacket(host, svc, output string, status int, iv []byte, ts uint32, password string) []byte {
+	var pkt []byte = make([]byte, NSCA_DATA_PACKET_SIZE)
+	var i int
+
+	binary.BigEndian.PutUint16(pkt[0:], 3)
+	binary.BigEndian.PutUint32(pkt[8:], ts)
+	binary.BigEndian.PutUint16(pkt[12:], uint16(status))
+	copy(pkt[14:14+63], host)
+	copy(pkt[78:78+127], svc)
+	copy(pkt[206:206+511], output)
+	binary.BigEndian.PutUint32(pkt[4:], crc32.ChecksumIEEE(pkt))
+
+	for i = range pkt {
+		pkt[i] ^= iv[i%len(iv)]
+		pkt[i] ^= password[i%len(password)]
+	}
+
+	return pkt
+}
+
+func TestNscaServiceSend(t *testing.T) {
+	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["nscaservice"]
+	var iv []byte = make([]byte, NSCA_IV_SIZE)
+	var ts uint32 = 1234567890
+	var listener net.Listener
+	var packets chan []byte
+	var nsca *NscaService
+	var pkt []byte
+	var err error
+	var i int
+
+	for i = range iv {
+		iv[i] = byte(i * 7)
+	}
+
+	listener, packets = mockNscaServer(t, iv, ts)
+	defer listener.Close()
+
+	// first end-point is not listening, the second is the fake server
+	sc.DialOn = fmt.Sprintf("127.0.0.1:1, %s", listener.Addr().String())
+
+	Convey("Should be able to instantiate NSCA service", t, func() {
+		nsca, err = NewNscaService(&sc, populatedCache())
+		So(err, ShouldEqual, nil)
+		So(len(nsca.DialOn), ShouldEqual, 2)
+	})
+
+	Convey("Should submit check results using the NSCA protocol", t, func() {
+		err = nsca.Send()
+		So(err, ShouldEqual, nil)
+
+		pkt = <-packets
+		So(len(pkt), ShouldEqual, NSCA_DATA_PACKET_SIZE)
+		So(bytes.Equal(
+			pkt,
+			expectedNscaPacket(
+				"godutch.local", "check_test", "Mocked", 0, iv, ts, "godutch"),
+		), ShouldBeTrue)
+	})
+
+	Convey("Should not submit the same check result twice", t, func() {
+		err = nsca.Send()
+		So(err, ShouldEqual, nil)
+
+		// the fake server must not receive anything else
+		pkt = nil
+		select {
+		case pkt = <-packets:
+		case <-time.After(500 * time.Millisecond):
+		}
+		So(pkt, ShouldBeNil)
+	})
+}
+
+func TestNscaServiceEncryption(t *testing.T) {
+	var sc ServiceConfig = ServiceConfig{Encryption: 42}
+	var err error
+
+	Convey("Should refuse unsupported encryption methods", t, func() {
+		_, err = NewNscaService(&sc, populatedCache())
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
+/* EOF */
@@ -0,0 +1,221 @@
+package godutch
+
+//
+// OutputLog keeps what a container's background command writes on stdout and
+// stderr: the last lines are held in memory, to be inspected when a container
+// misbehaves, and optionally all lines are written on a log file, rotated by
+// size, keeping a few old files around.
+//
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// default amount of lines kept in memory
+	OUTPUT_LOG_DEFAULT_TAIL = 100
+	// default size of log file before rotating, and amount of old files kept
+	OUTPUT_LOG_DEFAULT_MAX_SIZE = 10 * 1024 * 1024
+	OUTPUT_LOG_DEFAULT_BACKUPS  = 3
+	// stream names, besides output streams, GoDutch reports process exits
+	OUTPUT_STREAM_STDOUT = "stdout"
+	OUTPUT_STREAM_STDERR = "stderr"
+	OUTPUT_STREAM_EXIT   = "exit"
+)
+
+//
+// A line written by the background command, and when it was read.
+//
+type OutputLine struct {
+	Ts     time.Time `json:"ts"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+//
+// Ring buffer of the last lines, plus the log file, when configured.
+//
+type OutputLog struct {
+	mutex sync.Mutex
+	lines []OutputLine
+	// position of the next line on ring buffer, and whether it's full
+	next int
+	full bool
+	// log file path, maximum size and amount of rotated files kept
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+// Creates a new output log keeping informed amount of lines in memory, and
+// writing them on informed path too, when not empty. Log file is opened on
+// first write. Zero values select the defaults.
+func NewOutputLog(tail int, path string, maxSize int64, backups int) *OutputLog {
+	if tail <= 0 {
+		tail = OUTPUT_LOG_DEFAULT_TAIL
+	}
+	if maxSize <= 0 {
+		maxSize = OUTPUT_LOG_DEFAULT_MAX_SIZE
+	}
+	if backups <= 0 {
+		backups = OUTPUT_LOG_DEFAULT_BACKUPS
+	}
+
+	return &OutputLog{
+		lines:   make([]OutputLine, tail),
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+}
+
+// Creates the output log described on container configuration, log file is
+// named after the container, on it's log directory.
+func NewOutputLogFromConfig(cfg *ContainerConfig) *OutputLog {
+	var path string
+
+	if cfg.LogDir != "" {
+		path = filepath.Join(cfg.LogDir, fmt.Sprintf("%s.log", cfg.Name))
+	}
+
+	return NewOutputLog(cfg.LogTail, path, int64(cfg.LogMaxSize)*1024*1024,
+		cfg.LogBackups)
+}
+
+// Records a line of informed stream, on memory and on log file. Errors on log
+// file are returned, the line is kept in memory regardless.
+func (o *OutputLog) Write(stream string, text string) error {
+	var line OutputLine = OutputLine{Ts: time.Now(), Stream: stream, Text: text}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.lines[o.next] = line
+	if o.next = (o.next + 1) % len(o.lines); o.next == 0 {
+		o.full = true
+	}
+
+	if o.path == "" {
+		return nil
+	}
+
+	return o.writeFile(line)
+}
+
+// Returns the lines kept in memory, oldest first.
+func (o *OutputLog) Tail() []OutputLine {
+	var tail []OutputLine = []OutputLine{}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.full {
+		tail = append(tail, o.lines[o.next:]...)
+	}
+	return append(tail, o.lines[:o.next]...)
+}
+
+// Path of the log file, empty when not writing on file.
+func (o *OutputLog) Path() string {
+	return o.path
+}
+
+// Closes the log file, it's opened again on next write.
+func (o *OutputLog) Close() error {
+	var err error
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.file == nil {
+		return nil
+	}
+	err = o.file.Close()
+	o.file = nil
+
+	return err
+}
+
+// Writes a line on log file, rotating it when the line does not fit. Lock must
+// be held by the caller.
+func (o *OutputLog) writeFile(line OutputLine) error {
+	var entry string = fmt.Sprintf("%s [%s] %s\n",
+		line.Ts.Format(time.RFC3339), line.Stream, line.Text)
+	var n int
+	var err error
+
+	if o.file == nil {
+		if err = o.open(); err != nil {
+			return err
+		}
+	}
+
+	if o.size > 0 && o.size+int64(len(entry)) > o.maxSize {
+		if err = o.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err = o.file.WriteString(entry)
+	o.size += int64(n)
+
+	return err
+}
+
+// Opens the log file for appending, creating it when needed. Lock must be held
+// by the caller.
+func (o *OutputLog) open() error {
+	var info os.FileInfo
+	var err error
+
+	if err = os.MkdirAll(filepath.Dir(o.path), 0750); err != nil {
+		return err
+	}
+
+	if o.file, err = os.OpenFile(
+		o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+		return err
+	}
+
+	if info, err = o.file.Stat(); err != nil {
+		o.file.Close()
+		o.file = nil
+		return err
+	}
+	o.size = info.Size()
+
+	return nil
+}
+
+// Rotates the log file: "name.log" becomes "name.log.1", the older ones are
+// shifted, and the oldest beyond the amount of backups is removed. Lock must be
+// held by the caller.
+func (o *OutputLog) rotate() error {
+	var i int
+	var err error
+
+	if err = o.file.Close(); err != nil {
+		return err
+	}
+	o.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", o.path, o.backups))
+	for i = o.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", o.path, i),
+			fmt.Sprintf("%s.%d", o.path, i+1))
+	}
+
+	if err = os.Rename(o.path, o.path+".1"); err != nil {
+		return err
+	}
+
+	return o.open()
+}
+
+/* EOF */
@@ -0,0 +1,85 @@
+package godutch_test
+
+import (
+	"fmt"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputLogTail(t *testing.T) {
+	var o *OutputLog = NewOutputLog(3, "", 0, 0)
+	var tail []OutputLine
+	var i int
+
+	Convey("Should keep only the last lines, oldest first.", t, func() {
+		So(len(o.Tail()), ShouldEqual, 0)
+
+		for i = 1; i <= 5; i++ {
+			So(o.Write(OUTPUT_STREAM_STDOUT, fmt.Sprintf("line %d", i)),
+				ShouldEqual, nil)
+		}
+		So(o.Write(OUTPUT_STREAM_STDERR, "line 6"), ShouldEqual, nil)
+
+		tail = o.Tail()
+		So(len(tail), ShouldEqual, 3)
+		So(tail[0].Text, ShouldEqual, "line 4")
+		So(tail[1].Text, ShouldEqual, "line 5")
+		So(tail[2].Text, ShouldEqual, "line 6")
+		So(tail[2].Stream, ShouldEqual, OUTPUT_STREAM_STDERR)
+		So(o.Path(), ShouldEqual, "")
+	})
+}
+
+func TestOutputLogFile(t *testing.T) {
+	var dir string
+	var path string
+	var o *OutputLog
+	var payload []byte
+	var i int
+	var err error
+
+	dir, err = ioutil.TempDir("", "godutch-output-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path = filepath.Join(dir, "logs", "test.log")
+
+	Convey("Should create the log directory and write lines with stream.", t, func() {
+		o = NewOutputLog(10, path, 0, 0)
+		So(o.Write(OUTPUT_STREAM_STDERR, "something went wrong"), ShouldEqual, nil)
+		So(o.Close(), ShouldEqual, nil)
+
+		payload, err = ioutil.ReadFile(path)
+		So(err, ShouldEqual, nil)
+		So(string(payload), ShouldEndWith, "[stderr] something went wrong\n")
+	})
+
+	Convey("Should rotate by size, keeping the amount of backups.", t, func() {
+		o = NewOutputLog(10, path, 128, 2)
+		defer o.Close()
+
+		for i = 0; i < 20; i++ {
+			So(o.Write(OUTPUT_STREAM_STDOUT, fmt.Sprintf("line %02d", i)),
+				ShouldEqual, nil)
+		}
+
+		_, err = os.Stat(path + ".1")
+		So(err, ShouldEqual, nil)
+		_, err = os.Stat(path + ".2")
+		So(err, ShouldEqual, nil)
+		_, err = os.Stat(path + ".3")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		payload, err = ioutil.ReadFile(path)
+		So(err, ShouldEqual, nil)
+		So(len(payload), ShouldBeLessThanOrEqualTo, 128)
+		So(string(payload), ShouldEndWith, "[stdout] line 19\n")
+	})
+}
+
+/* EOF */
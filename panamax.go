@@ -9,36 +9,67 @@ package godutch
 
 import (
 	"errors"
+	"fmt"
 	gocache "github.com/patrickmn/go-cache"
 	"github.com/thejerf/suture"
-	"log"
+	"sort"
+	"sync"
 	"time"
 )
 
 //
-// Containers and Checks inventory, plus Supervisor structure.
+// Containers and Checks inventory, plus Supervisor structure. Inventory and
+// last-run bookkeeping are protected by a read-write mutex, since checks are
+// executed concurrently, while containers can be loaded and unloaded.
 //
 type Panamax struct {
 	*suture.Supervisor
+	mutex        sync.RWMutex
 	containers   map[string]*Container
+	tokens       map[string]suture.ServiceToken
 	checks       map[string]*Container
 	checkLastRun map[string]int64
 	cache        *gocache.Cache
+	// TCP ports for containers, when not using UNIX sockets
+	ports *PortRange
+	// maximum amount of time waiting for in-flight requests on unload
+	maxDrain time.Duration
+	// output of containers that failed to load, until the next attempt
+	failedOutput map[string]*OutputLog
+	logger       *Logger
+}
+
+//
+// Description of a loaded container, used to report Panamax contents.
+//
+type ContainerInfo struct {
+	Name         string   `json:"name"`
+	Command      []string `json:"command"`
+	Checks       []string `json:"checks"`
+	Pid          int      `json:"pid"`
+	Bootstrapped bool     `json:"bootstrapped"`
 }
 
 // Creates a new Panamax instnace. Alocates memotry and loads a new supervisor
 // instance to hold the Containers.
 func NewPanamax(cache *gocache.Cache) (*Panamax, error) {
 	var p *Panamax = &Panamax{
-		Supervisor: suture.New("Panamax", suture.Spec{
-			Log: func(line string) { log.Println("[SUTURE]", line) },
-		}),
 		containers:   make(map[string]*Container),
+		tokens:       make(map[string]suture.ServiceToken),
 		checks:       make(map[string]*Container),
 		checkLastRun: make(map[string]int64),
 		cache:        cache,
+		maxDrain:     GODUTCH_DEFAULT_SHUTDOWN_TIMEOUT,
+		failedOutput: make(map[string]*OutputLog),
+		logger:       DefaultLogger().With("component", "Panamax"),
 	}
 
+	p.Supervisor = suture.New("Panamax", suture.Spec{
+		Log: func(line string) {
+			p.logger.With("component", "Suture").Warnf("%s", line)
+		},
+	})
+
 	// letting the Supervisor run in background right from the start, it will be
 	// requested to be on running state when onboarding containers
 	go p.ServeBackground()
@@ -46,79 +77,505 @@ func NewPanamax(cache *gocache.Cache) (*Panamax, error) {
 	return p, nil
 }
 
+// Replaces the logger, containers loaded from now on inherit it.
+func (p *Panamax) SetLogger(l *Logger) {
+	p.logger = l.With("component", "Panamax")
+}
+
+// Limits the amount of time in-flight requests are waited for when unloading a
+// container, which otherwise waits for the longest timeout of it's checks.
+func (p *Panamax) SetMaxDrain(timeout time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.maxDrain = timeout
+}
+
+// Switches containers transport to TCP, allocating a port out of informed range
+// ("first-last") for each container loaded from now on.
+func (p *Panamax) UseTCPPorts(portsRange string) error {
+	var ports *PortRange
+	var err error
+
+	if ports, err = NewPortRange(portsRange); err != nil {
+		return err
+	}
+
+	p.logger.Infof("Using TCP ports range: '%s'", portsRange)
+	p.mutex.Lock()
+	p.ports = ports
+	p.mutex.Unlock()
+
+	return nil
+}
+
+// Creates the transport for a container, a TCP port when a range of ports is
+// in use, or a UNIX socket otherwise. Lock must be held by the caller.
+func (p *Panamax) newTransport(cfg *ContainerConfig) (*Transport, error) {
+	var port int
+	var err error
+
+	if p.ports == nil {
+		return NewUnixTransport(cfg), nil
+	}
+
+	if port, err = p.ports.Allocate(); err != nil {
+		return nil, err
+	}
+
+	p.logger.With("container", cfg.Name).Infof(
+		"Container will listen on port: '%d'", port)
+	return NewTCPTransport(port), nil
+}
+
+// Releases the TCP port of a transport, if any. Lock must be held by caller.
+func (p *Panamax) releaseTransport(t *Transport) {
+	if p.ports != nil && t.Network == "tcp" {
+		p.ports.Release(t.Port)
+	}
+}
+
 // Loads a container based on configuration, starting command in background and
 // loading it's inventory right after. When Container has no checks it will
-// return error.
+// return error. Lock is not held while the container is bootstrapping.
 func (p *Panamax) Load(cfg *ContainerConfig) error {
 	var found bool = false
+	var c *Container
+	var t *Transport
+	var token suture.ServiceToken
 	var item string
+	var pid int
+	var logger *Logger = p.logger.With("container", cfg.Name)
 	var err error
 
-	log.Printf("[Panamax] Loading container: '%s'", cfg.Name)
+	logger.Infof("Loading container: '%s'", cfg.Name)
+
+	p.mutex.Lock()
 	if _, found = p.containers[cfg.Name]; found {
+		p.mutex.Unlock()
 		return errors.New("[Panamax] Container already loaded: " + cfg.Name)
 	}
+	// output of a previous failed attempt is replaced by this one
+	delete(p.failedOutput, cfg.Name)
+
+	if t, err = p.newTransport(cfg); err != nil {
+		p.mutex.Unlock()
+		return err
+	}
 
-	if p.containers[cfg.Name], err = NewContainer(cfg); err != nil {
+	if c, err = NewContainerWithTransport(cfg, t); err != nil {
+		p.releaseTransport(t)
+		p.mutex.Unlock()
 		return err
 	}
+	c.SetLogger(p.logger)
+
+	// loading container on local Supervisor, registering it right away, so the
+	// same container is not loaded twice
+	token = p.Add(c.Client())
+	p.containers[cfg.Name] = c
+	p.tokens[cfg.Name] = token
+	p.mutex.Unlock()
 
-	// loading container on local Supervisor and quick sleep, to give it time to
-	// start and be able to respond
-	p.Add(p.containers[cfg.Name].Client())
-	time.Sleep(1e9)
+	// waiting for the container to start and be able to respond
+	if err = c.WaitReady(); err != nil {
+		logger.Errorf("Container is not ready: %s", err)
+		p.discard(cfg.Name, token)
+		return err
+	}
 
-	if err = p.containers[cfg.Name].Bootstrap(); err != nil {
-		log.Printf("[Panamax] Error on boostrapping container")
+	if err = c.Bootstrap(); err != nil {
+		logger.Errorf("Error on boostrapping container: %s", err)
+		p.discard(cfg.Name, token)
 		return err
 	}
 
 	// having no checks found on this continer will return error
-	if len(p.containers[cfg.Name].Inventory()) <= 0 {
+	if len(c.Inventory()) <= 0 {
 		err = errors.New("[Panamax] No inventory found on: " + cfg.Name)
+		p.discard(cfg.Name, token)
 		return err
 	}
 
 	// loading container inventory
-	for _, item = range p.containers[cfg.Name].Inventory() {
-		log.Printf("[Panamax] Container '%s' has check: '%s'", cfg.Name, item)
-		p.checks[item] = p.containers[cfg.Name]
+	p.mutex.Lock()
+	for _, item = range c.Inventory() {
+		logger.With("check", item).Infof("Container has check: '%s'", item)
+		p.checks[item] = c
+	}
+	p.mutex.Unlock()
+
+	// refreshing the inventory when the Supervisor restarts the command, which
+	// might have happened already, while bootstrapping
+	c.Bg.OnStart(func(pid int) { p.refresh(c, pid) })
+	if pid = c.Bg.Pid(); pid != c.InventoryPid() {
+		go p.refresh(c, pid)
 	}
 
 	return nil
 }
 
+// Reloads the inventory of a container which command has been restarted, when
+// the new process is not the one the inventory was loaded from. Checks that
+// appeared or disappeared are reported, and the inventory is updated at once.
+func (p *Panamax) refresh(c *Container, pid int) {
+	var check string
+	var holder *Container
+	var current map[string]bool = make(map[string]bool)
+	var logger *Logger = p.logger.With("container", c.Name)
+	var err error
+
+	if c.InventoryPid() == pid {
+		return
+	}
+
+	logger.Infof("Container has been restarted (PID '%d'), reloading "+
+		"inventory.", pid)
+
+	if err = c.WaitReady(); err != nil {
+		logger.Errorf("Error on refreshing: %s", err)
+		return
+	}
+
+	if err = c.LoadInventory(); err != nil {
+		logger.Errorf("Error on refreshing: %s", err)
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// container might have been unloaded in the meantime
+	if p.containers[c.Name] != c {
+		return
+	}
+
+	for _, check = range c.Inventory() {
+		current[check] = true
+	}
+
+	for check, holder = range p.checks {
+		if holder == c && !current[check] {
+			logger.With("check", check).Warnf("Check disappeared: '%s'", check)
+			delete(p.checks, check)
+			delete(p.checkLastRun, check)
+		}
+	}
+
+	for check = range current {
+		if p.checks[check] != c {
+			logger.With("check", check).Infof("Check appeared: '%s'", check)
+			p.checks[check] = c
+		}
+	}
+}
+
+// Removes a container that failed to load from Supervisor and local registry.
+// It's output is kept, to be inspected until the next attempt to load it.
+func (p *Panamax) discard(name string, token suture.ServiceToken) {
+	var c *Container
+	var found bool
+	var err error
+
+	p.mutex.Lock()
+	if c, found = p.containers[name]; found {
+		p.releaseTransport(c.transport)
+		p.failedOutput[name] = c.Bg.Output()
+	}
+	delete(p.containers, name)
+	delete(p.tokens, name)
+	p.mutex.Unlock()
+
+	if err = p.Remove(token); err != nil {
+		p.logger.With("container", name).Errorf(
+			"Error on removing from supervisor: %s", err)
+	}
+
+	if found {
+		c.Bg.Output().Close()
+	}
+}
+
+// Unloads a container by name, removing it's checks from the inventory, then
+// waiting for the in-flight requests (up to container's timeout) before
+// removing it from the Supervisor, which will stop the background command.
+func (p *Panamax) Unload(name string) error {
+	var found bool = false
+	var c *Container
+	var token suture.ServiceToken
+	var check string
+	var drain time.Duration
+	var logger *Logger = p.logger.With("container", name)
+	var err error
+
+	logger.Infof("Unloading container: '%s'", name)
+
+	p.mutex.Lock()
+	if c, found = p.containers[name]; !found {
+		p.mutex.Unlock()
+		return errors.New("[Panamax] Container is not loaded: " + name)
+	}
+
+	for _, check = range c.Inventory() {
+		if p.checks[check] == c {
+			delete(p.checks, check)
+			delete(p.checkLastRun, check)
+		}
+	}
+
+	// waiting as long as the slowest check may run, up to the limit
+	if drain = c.LongestTimeout(); p.maxDrain > 0 && drain > p.maxDrain {
+		drain = p.maxDrain
+	}
+
+	token = p.tokens[name]
+	c.Bg.OnStart(nil)
+	p.releaseTransport(c.transport)
+	delete(p.containers, name)
+	delete(p.tokens, name)
+	p.mutex.Unlock()
+
+	if !c.Drain(drain) {
+		logger.Warnf("Container still has requests running.")
+	}
+
+	if err = p.Remove(token); err != nil {
+		logger.Errorf("Error on removing container from supervisor: %s", err)
+		return err
+	}
+
+	c.transport.Cleanup()
+	c.Bg.Output().Close()
+
+	return nil
+}
+
+// Waits for in-flight requests on all containers, returns false when requests
+// are still running after timeout.
+func (p *Panamax) Drain(timeout time.Duration) bool {
+	var deadline time.Time = time.Now().Add(timeout)
+	var containers []*Container
+	var c *Container
+	var drained bool = true
+
+	p.mutex.RLock()
+	for _, c = range p.containers {
+		containers = append(containers, c)
+	}
+	p.mutex.RUnlock()
+
+	for _, c = range containers {
+		if !c.Drain(time.Until(deadline)) {
+			p.logger.With("container", c.Name).Warnf(
+				"Container still has requests running.")
+			drained = false
+		}
+	}
+
+	return drained
+}
+
+// Stops the Supervisor, and therefore the containers, removing their socket
+// files afterwards.
+func (p *Panamax) Stop() {
+	var c *Container
+
+	p.logger.Infof("Stopping containers.")
+	p.Supervisor.Stop()
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, c = range p.containers {
+		c.transport.Cleanup()
+		c.Bg.Output().Close()
+	}
+}
+
+// Restarts a container through the Supervisor, by unloading and loading it
+// again using the same configuration, so it's inventory is reloaded as well.
+func (p *Panamax) Restart(name string) error {
+	var found bool = false
+	var c *Container
+	var err error
+
+	p.logger.With("container", name).Infof("Restarting container: '%s'", name)
+
+	p.mutex.RLock()
+	c, found = p.containers[name]
+	p.mutex.RUnlock()
+
+	if !found {
+		return errors.New("[Panamax] Container is not loaded: " + name)
+	}
+
+	if err = p.Unload(name); err != nil {
+		return err
+	}
+
+	return p.Load(c.cfg)
+}
+
+// Describes the loaded containers, sorted by name.
+func (p *Panamax) Containers() []ContainerInfo {
+	var name string
+	var names []string
+	var c *Container
+	var containers []ContainerInfo = []ContainerInfo{}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name = range p.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		c = p.containers[name]
+		containers = append(containers, ContainerInfo{
+			Name:         c.Name,
+			Command:      c.cfg.Command,
+			Checks:       c.Inventory(),
+			Pid:          c.Bg.Pid(),
+			Bootstrapped: c.Bootstrapped(),
+		})
+	}
+
+	return containers
+}
+
+// Returns the last lines written by a container's background command, on
+// stdout and stderr, oldest first. Containers that failed to load have their
+// last lines kept until they're loaded again.
+func (p *Panamax) Output(name string) ([]OutputLine, error) {
+	var c *Container
+	var output *OutputLog
+	var found bool
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if c, found = p.containers[name]; found {
+		return c.Bg.Output().Tail(), nil
+	}
+	if output, found = p.failedOutput[name]; found {
+		return output.Tail(), nil
+	}
+
+	return nil, errors.New("[Panamax] Container is not loaded: " + name)
+}
+
+// Lists the name of checks on inventory, sorted.
+func (p *Panamax) Checks() []string {
+	var name string
+	var checks []string = []string{}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name = range p.checks {
+		checks = append(checks, name)
+	}
+	sort.Strings(checks)
+
+	return checks
+}
+
+// Lists the checks inventory, mapping check names to the container that holds
+// them.
+func (p *Panamax) Inventory() map[string]string {
+	var name string
+	var c *Container
+	var inventory map[string]string = make(map[string]string)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name, c = range p.checks {
+		inventory[name] = c.Name
+	}
+
+	return inventory
+}
+
+// Lists the metadata of every check on inventory, checks which container does
+// not advertise metadata are described by name only.
+func (p *Panamax) Metadata() map[string]CheckMetadata {
+	var name string
+	var c *Container
+	var metadata map[string]CheckMetadata = make(map[string]CheckMetadata)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name, c = range p.checks {
+		metadata[name], _ = c.MetadataFor(name)
+	}
+
+	return metadata
+}
+
+// Lists the schedule of every check on inventory.
+func (p *Panamax) Schedules() map[string]CheckSchedule {
+	var name string
+	var c *Container
+	var schedules map[string]CheckSchedule = make(map[string]CheckSchedule)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name, c = range p.checks {
+		schedules[name] = c.ScheduleFor(name)
+	}
+
+	return schedules
+}
+
 // Wraps the Execute method from the Container using local inventory, save the
-// results into Cache.
+// results into Cache. Lock is not held while the check is running.
 func (p *Panamax) Execute(req *Request) (*Response, error) {
 	var name string = req.Fields.Command
 	var found bool = false
+	var c *Container
 	var resp *Response
 	var err error
 
 	// check's command is it's name, can be found on Request's fields
-	if _, found = p.checks[name]; !found {
-		log.Printf("[Panamax] Can't find check named '%s'", name)
-		err = errors.New("[Panamax] Can't find a check named:" + name)
-		return nil, err
+	p.mutex.RLock()
+	c, found = p.checks[name]
+	p.mutex.RUnlock()
+
+	if !found {
+		p.logger.With("check", name).Warnf("Can't find check named '%s'", name)
+		return nil, fmt.Errorf("%w: '%s'", ErrCheckNotFound, name)
 	}
 
-	if resp, err = p.checks[name].Execute(req); err != nil {
+	if resp, err = c.Execute(req); err != nil {
 		return nil, err
 	}
 
 	// saving object on cache
 	p.cache.Set(name, resp, gocache.DefaultExpiration)
-	log.Printf("[Panamax] Cache count: '%d'", p.cache.ItemCount())
+	p.logger.Debugf("Cache count: '%d'", p.cache.ItemCount())
 
 	// saving last run on local punched card
+	p.mutex.Lock()
 	p.checkLastRun[name] = time.Now().Unix()
+	p.mutex.Unlock()
 
 	return resp, nil
 }
 
 // For a given check name returns the amounf of seconds since it's last run.
 func (p *Panamax) CheckLastRun(name string) int64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.lastRunOf(name)
+}
+
+// Returns the amount of seconds since check's last run, or -1 when it has
+// never ran. Lock must be held by the caller.
+func (p *Panamax) lastRunOf(name string) int64 {
 	var found bool
 	var lastRunTs int64
 	if lastRunTs, found = p.checkLastRun[name]; !found {
@@ -128,6 +585,22 @@ func (p *Panamax) CheckLastRun(name string) int64 {
 	return time.Now().Unix() - lastRunTs
 }
 
+// Snapshot of the last run of every check on inventory, in seconds from now,
+// where -1 means the check has never ran.
+func (p *Panamax) LastRuns() map[string]int64 {
+	var name string
+	var lastRuns map[string]int64 = make(map[string]int64)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for name = range p.checks {
+		lastRuns[name] = p.lastRunOf(name)
+	}
+
+	return lastRuns
+}
+
 // Go through the existing checks and build up a map having check's name as key
 // and last run (seconds from now) as value.
 func (p *Panamax) ChecksRunReport(threshold int64) map[string]int64 {
@@ -135,16 +608,16 @@ func (p *Panamax) ChecksRunReport(threshold int64) map[string]int64 {
 	var lastRun int64
 	var report map[string]int64 = make(map[string]int64)
 
-	for name, _ = range p.checks {
-		lastRun = p.CheckLastRun(name)
-		log.Printf("[Panamax] Check '%s' has it's last run %ds ago.", name, lastRun)
+	for name, lastRun = range p.LastRuns() {
+		p.logger.With("check", name).Debugf(
+			"Check has it's last run %ds ago.", lastRun)
 		// check's last run must be above the threshold, and last run not set to
 		// -1 which means the check has never ran before
 		if lastRun >= 0 && lastRun < threshold {
 			continue
 		}
-		log.Printf("[Panamax] Check '%s' is delayed by %ds (out of %ds)",
-			name, lastRun, threshold)
+		p.logger.With("check", name).Debugf("Check is delayed by %ds (out of %ds)",
+			lastRun, threshold)
 		report[name] = lastRun
 	}
 
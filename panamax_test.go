@@ -1,9 +1,23 @@
 package godutch_test
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	. "github.com/otaviof/godutch"
 	gocache "github.com/patrickmn/go-cache"
 	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -23,6 +37,513 @@ func mockPanamax(t *testing.T) *Panamax {
 	return p
 }
 
+// Not a real test, when GODUTCH_SOCKET_PATH (or GODUTCH_TCP_ADDRESS) is set the
+// test binary acts as a container, serving the checks informed as arguments
+// after "--". It's used as command on containers that don't depend on external
+// interpreters. Arguments starting with "+" change the container's behaviour:
+// "+describe" describes the checks, "+slow" takes a second to start listening,
+// "+never" never does, "+ignore-term" ignores SIGTERM, "+chatty" writes more
+// than a pipe buffer on stderr before listening, and "+checks-file=path" serves
+// the checks listed on the file as well, read on startup.
+func TestHelperContainer(t *testing.T) {
+	var socketPath string = os.Getenv("GODUTCH_SOCKET_PATH")
+	var tcpAddress string = os.Getenv("GODUTCH_TCP_ADDRESS")
+	var options map[string]bool = make(map[string]bool)
+	var checks []string
+	var arg string
+	var i int
+	var listener net.Listener
+	var conn net.Conn
+	var err error
+
+	if socketPath == "" && tcpAddress == "" {
+		return
+	}
+
+	for _, arg = range flag.Args() {
+		if strings.HasPrefix(arg, "+checks-file=") {
+			payload, _ := ioutil.ReadFile(strings.TrimPrefix(arg, "+checks-file="))
+			checks = append(checks, strings.Fields(string(payload))...)
+		} else if strings.HasPrefix(arg, "+") {
+			options[arg] = true
+		} else {
+			checks = append(checks, arg)
+		}
+	}
+
+	if options["+ignore-term"] {
+		signal.Ignore(syscall.SIGTERM)
+	}
+	if options["+never"] {
+		time.Sleep(time.Hour)
+	}
+	if options["+slow"] {
+		time.Sleep(time.Second)
+	}
+	if options["+chatty"] {
+		fmt.Fprintln(os.Stdout, "helper starting")
+		for i = 0; i < 4096; i++ {
+			fmt.Fprintf(os.Stderr, "helper warning %d %s\n", i, strings.Repeat("-", 64))
+		}
+	}
+
+	switch {
+	case socketPath != "":
+		os.Remove(socketPath)
+		listener, err = net.Listen("unix", socketPath)
+	default:
+		listener, err = net.Listen("tcp", tcpAddress)
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
+
+	for {
+		if conn, err = listener.Accept(); err != nil {
+			os.Exit(1)
+		}
+		go helperContainerHandler(conn, checks, options["+describe"])
+	}
+}
+
+// Answers a single request, listing the informed checks or executing them.
+func helperContainerHandler(conn net.Conn, checks []string, describe bool) {
+	var line string
+	var fields map[string]interface{}
+	var resp *Response
+	var check string
+
+	defer conn.Close()
+
+	line, _ = bufio.NewReader(conn).ReadString('\n')
+	json.Unmarshal([]byte(line), &fields)
+
+	switch fields["command"] {
+	case "__ping":
+		resp = &Response{Name: "__ping", Stdout: []string{"pong"}}
+	case "__describe_checks":
+		// like older agents, answering with error when not describing checks
+		if !describe {
+			resp = &Response{Name: "__describe_checks", Status: 3,
+				Error: "unknown method"}
+			break
+		}
+		resp = &Response{Name: "__describe_checks"}
+		for _, check = range checks {
+			resp.Checks = append(resp.Checks, CheckMetadata{
+				Name:        check,
+				Description: "Helper check",
+				Arguments:   []string{"default"},
+				Interval:    7,
+				Timeout:     3,
+				Metrics:     []MetricMetadata{{Name: "okay", Unit: "count"}},
+				Tags:        []string{"helper"},
+			})
+		}
+	case "__list_check_methods":
+		resp = &Response{Name: "__list_check_methods", Stdout: checks}
+	default:
+		// checks named with "sleep" take a second to run, "slumber" three
+		if strings.Contains(fields["command"].(string), "sleep") {
+			time.Sleep(time.Second)
+		}
+		if strings.Contains(fields["command"].(string), "slumber") {
+			time.Sleep(3 * time.Second)
+		}
+		resp = &Response{
+			Name:    fields["command"].(string),
+			Status:  0,
+			Stdout:  []string{"helper output", fmt.Sprint(fields["arguments"])},
+			Metrics: Metrics{{Name: "okay", Value: 1}},
+		}
+	}
+
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Returns configuration for a container served by the test binary itself, with
+// informed checks.
+func mockHelperContainerConfig(name string, checks ...string) *ContainerConfig {
+	return &ContainerConfig{
+		Enabled:   true,
+		Name:      name,
+		SocketDir: os.TempDir(),
+		Command: append(
+			[]string{os.Args[0], "-test.run=^TestHelperContainer$", "--"},
+			checks...),
+	}
+}
+
+// Writes a container INI file, using the test binary as helper container.
+func writeHelperContainerINI(t *testing.T, path string, name string, checks ...string) {
+	var cfg *ContainerConfig = mockHelperContainerConfig(name, checks...)
+	var payload string = fmt.Sprintf(
+		"[Container]\nname = %s\nenabled = 1\nsocket_dir = %s\ncommand = %s\n",
+		name, cfg.SocketDir, strings.Join(cfg.Command, ", "))
+
+	if err := ioutil.WriteFile(path, []byte(payload), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPanamaxConcurrency(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var helperCfg *ContainerConfig = mockHelperContainerConfig(
+		"helper", "check_a", "check_b")
+	var otherCfg *ContainerConfig = mockHelperContainerConfig(
+		"other", "check_c")
+	var wg sync.WaitGroup
+	var failures int32
+	var i int
+	var err error
+
+	Convey("Should load a helper container on Panamax", t, func() {
+		err = p.Load(helperCfg)
+		So(err, ShouldEqual, nil)
+		So(p.Inventory(), ShouldResemble,
+			map[string]string{"check_a": "helper", "check_b": "helper"})
+	})
+	defer p.Unload("helper")
+
+	// executing checks, while reading snapshots and loading another container
+	for i = 0; i < 50; i++ {
+		wg.Add(3)
+		go func(name string) {
+			var req *Request
+			defer wg.Done()
+			req, _ = NewRequest(name, []string{})
+			if _, err := p.Execute(req); err != nil {
+				atomic.AddInt32(&failures, 1)
+			}
+		}([]string{"check_a", "check_b"}[i%2])
+		go func() {
+			defer wg.Done()
+			p.Containers()
+			p.ChecksRunReport(10)
+		}()
+		go func() {
+			defer wg.Done()
+			p.LastRuns()
+			p.Checks()
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := p.Load(otherCfg); err != nil {
+			atomic.AddInt32(&failures, 1)
+		}
+	}()
+	wg.Wait()
+
+	Convey("Should execute checks while inventory changes", t, func() {
+		So(atomic.LoadInt32(&failures), ShouldEqual, 0)
+		So(p.LastRuns()["check_a"], ShouldBeGreaterThanOrEqualTo, 0)
+		So(p.LastRuns()["check_c"], ShouldEqual, -1)
+		So(len(p.Containers()), ShouldEqual, 2)
+		So(p.Containers()[0].Pid, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Should return ErrCheckNotFound for unknown checks", t, func() {
+		req, _ := NewRequest("check_dummy", []string{})
+		_, err = p.Execute(req)
+		So(errors.Is(err, ErrCheckNotFound), ShouldBeTrue)
+	})
+
+	Convey("Should unload a container and it's checks", t, func() {
+		err = p.Unload("other")
+		So(err, ShouldEqual, nil)
+		So(p.Checks(), ShouldResemble, []string{"check_a", "check_b"})
+	})
+}
+
+func TestPanamaxMetadata(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var describedCfg *ContainerConfig = mockHelperContainerConfig(
+		"described", "+describe", "check_described")
+	var listedCfg *ContainerConfig = mockHelperContainerConfig(
+		"listed", "check_listed")
+	var overriddenCfg *ContainerConfig = mockHelperContainerConfig(
+		"overridden", "+describe", "check_overridden", "check_pinned")
+	var metadata map[string]CheckMetadata
+	var req *Request
+	var resp *Response
+	var err error
+
+	Convey("Should load containers describing and listing checks", t, func() {
+		err = p.Load(describedCfg)
+		So(err, ShouldEqual, nil)
+		err = p.Load(listedCfg)
+		So(err, ShouldEqual, nil)
+		So(p.Checks(), ShouldResemble, []string{"check_described", "check_listed"})
+	})
+	defer p.Unload("described")
+	defer p.Unload("listed")
+
+	Convey("Should expose the advertised metadata", t, func() {
+		metadata = p.Metadata()
+		So(metadata["check_described"].Description, ShouldEqual, "Helper check")
+		So(metadata["check_described"].Metrics[0].Unit, ShouldEqual, "count")
+		So(metadata["check_described"].Tags, ShouldResemble, []string{"helper"})
+		So(metadata["check_listed"], ShouldResemble,
+			CheckMetadata{Name: "check_listed"})
+	})
+
+	Convey("Should schedule using the advertised interval", t, func() {
+		So(p.Schedules()["check_described"].Interval, ShouldEqual, 7*time.Second)
+		So(p.Schedules()["check_listed"].Interval, ShouldEqual, 0)
+	})
+
+	Convey("Should prefer container configuration over advertised values", t, func() {
+		overriddenCfg.Interval = 20
+		overriddenCfg.CheckInterval = []string{"check_pinned:5"}
+		err = p.Load(overriddenCfg)
+		So(err, ShouldEqual, nil)
+		defer p.Unload("overridden")
+
+		So(p.Schedules()["check_overridden"].Interval, ShouldEqual, 20*time.Second)
+		So(p.Schedules()["check_pinned"].Interval, ShouldEqual, 5*time.Second)
+	})
+
+	Convey("Should execute using the default arguments", t, func() {
+		req, _ = NewRequest("check_described", []string{})
+		resp, err = p.Execute(req)
+		So(err, ShouldEqual, nil)
+		So(resp.Stdout[1], ShouldEqual, "[default]")
+
+		req, _ = NewRequest("check_described", []string{"other"})
+		resp, err = p.Execute(req)
+		So(err, ShouldEqual, nil)
+		So(resp.Stdout[1], ShouldEqual, "[other]")
+	})
+}
+
+func TestPanamaxTCPTransport(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig("tcp", "check_tcp")
+	var req *Request
+	var resp *Response
+	var err error
+
+	Convey("Should load a container over TCP", t, func() {
+		err = p.UseTCPPorts("22111-22113")
+		So(err, ShouldEqual, nil)
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+		So(p.Checks(), ShouldResemble, []string{"check_tcp"})
+	})
+
+	Convey("Should execute a check over TCP", t, func() {
+		req, _ = NewRequest("check_tcp", []string{})
+		resp, err = p.Execute(req)
+		So(err, ShouldEqual, nil)
+		So(resp.Stdout[0], ShouldEqual, "helper output")
+	})
+
+	Convey("Should release the port when unloading", t, func() {
+		err = p.Unload("tcp")
+		So(err, ShouldEqual, nil)
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+		err = p.Unload("tcp")
+		So(err, ShouldEqual, nil)
+	})
+}
+
+func TestPanamaxSocketLifecycle(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig("sockets", "check_sockets")
+	var socketPath string = filepath.Join(cfg.SocketDir, "godutch-sockets.sock")
+	var okay bool
+	var err error
+
+	Convey("Should load a container over a stale socket file", t, func() {
+		err = ioutil.WriteFile(socketPath, []byte("stale"), 0600)
+		So(err, ShouldEqual, nil)
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+	})
+
+	Convey("Should remove the socket file when unloading", t, func() {
+		err = p.Unload("sockets")
+		So(err, ShouldEqual, nil)
+		_, err = os.Stat(socketPath)
+		okay = os.IsNotExist(err)
+		So(okay, ShouldBeTrue)
+	})
+}
+
+func TestPanamaxReadiness(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var slowCfg *ContainerConfig = mockHelperContainerConfig(
+		"slow", "+slow", "check_slow")
+	var neverCfg *ContainerConfig = mockHelperContainerConfig(
+		"never", "+never", "check_never")
+	var start time.Time
+	var err error
+
+	Convey("Should wait for a slow container to be ready", t, func() {
+		err = p.Load(slowCfg)
+		So(err, ShouldEqual, nil)
+		So(p.Checks(), ShouldResemble, []string{"check_slow"})
+	})
+	defer p.Unload("slow")
+
+	Convey("Should give up on a container that is never ready", t, func() {
+		neverCfg.StartupTimeout = 1
+		start = time.Now()
+		err = p.Load(neverCfg)
+		So(errors.Is(err, ErrContainerNotReady), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "never")
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+		So(len(p.Containers()), ShouldEqual, 1)
+	})
+}
+
+func TestPanamaxUnloadDrain(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig(
+		"draining", "check_slumber")
+	var done chan struct{}
+	var resp *Response
+	var execErr error
+	var start time.Time
+	var err error
+
+	// container default is shorter than the check running while unloading
+	cfg.Timeout = 1
+	cfg.CheckTimeout = []string{"check_slumber:5"}
+
+	executeSlumber := func() {
+		done = make(chan struct{})
+		go func() {
+			req, _ := NewRequest("check_slumber", []string{})
+			resp, execErr = p.Execute(req)
+			close(done)
+		}()
+		// making sure the check is running
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	Convey("Should wait for the longest check timeout on unload", t, func() {
+		So(p.Load(cfg), ShouldEqual, nil)
+		executeSlumber()
+
+		err = p.Unload("draining")
+		So(err, ShouldEqual, nil)
+		So(waitClosed(done, time.Second), ShouldBeTrue)
+		So(execErr, ShouldEqual, nil)
+		So(resp.Stdout[0], ShouldEqual, "helper output")
+	})
+
+	Convey("Should not wait longer than the maximum drain", t, func() {
+		So(p.Load(cfg), ShouldEqual, nil)
+		executeSlumber()
+
+		p.SetMaxDrain(500 * time.Millisecond)
+		start = time.Now()
+		err = p.Unload("draining")
+		So(err, ShouldEqual, nil)
+		So(time.Since(start), ShouldBeLessThan, 2*time.Second)
+		So(waitClosed(done, 5*time.Second), ShouldBeTrue)
+	})
+}
+
+func TestPanamaxOutput(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig(
+		"chatty", "+chatty", "check_chatty")
+	var lines []OutputLine
+	var streams map[string]int
+	var line OutputLine
+	var i int
+	var err error
+
+	cfg.LogTail = 5000
+
+	Convey("Should load a container writing a lot on stderr", t, func() {
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+	})
+	defer p.Unload("chatty")
+
+	Convey("Should keep container's output, tagged by stream", t, func() {
+		for i = 0; i < 50; i++ {
+			streams = make(map[string]int)
+			lines, err = p.Output("chatty")
+			So(err, ShouldEqual, nil)
+			for _, line = range lines {
+				streams[line.Stream]++
+			}
+			if streams[OUTPUT_STREAM_STDERR] == 4096 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		So(streams[OUTPUT_STREAM_STDOUT], ShouldEqual, 1)
+		So(streams[OUTPUT_STREAM_STDERR], ShouldEqual, 4096)
+	})
+
+	Convey("Should refuse unknown containers", t, func() {
+		_, err = p.Output("unknown")
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should keep the output of containers that failed to load", t, func() {
+		// writing on output, but serving no checks
+		err = p.Load(mockHelperContainerConfig("failed", "+chatty"))
+		So(err, ShouldNotEqual, nil)
+
+		lines, err = p.Output("failed")
+		So(err, ShouldEqual, nil)
+		So(len(lines), ShouldBeGreaterThan, 0)
+		So(lines[len(lines)-1].Stream, ShouldEqual, OUTPUT_STREAM_STDERR)
+		So(lines[len(lines)-1].Text, ShouldStartWith, "helper warning")
+	})
+}
+
+func TestPanamaxRefreshOnRestart(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var checksFile string = filepath.Join(os.TempDir(), "godutch-refresh-checks")
+	var cfg *ContainerConfig = mockHelperContainerConfig(
+		"refresh", "+checks-file="+checksFile)
+	var pid int
+	var i int
+	var err error
+
+	defer os.Remove(checksFile)
+
+	Convey("Should load the checks listed on file", t, func() {
+		err = ioutil.WriteFile(checksFile, []byte("check_old check_kept"), 0600)
+		So(err, ShouldEqual, nil)
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+		So(p.Checks(), ShouldResemble, []string{"check_kept", "check_old"})
+	})
+	defer p.Unload("refresh")
+
+	Convey("Should reload the inventory after a restart", t, func() {
+		err = ioutil.WriteFile(checksFile, []byte("check_new check_kept"), 0600)
+		So(err, ShouldEqual, nil)
+
+		pid = p.Containers()[0].Pid
+		// killing the command, the Supervisor starts it again
+		syscall.Kill(pid, syscall.SIGKILL)
+
+		for i = 0; i < 50; i++ {
+			if p.Inventory()["check_new"] != "" {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		So(p.Checks(), ShouldResemble, []string{"check_kept", "check_new"})
+		So(p.Containers()[0].Pid, ShouldNotEqual, pid)
+	})
+}
+
 func TestLoadAndExecute(t *testing.T) {
 	var p *Panamax = mockPanamax(t)
 	var cfg *Config = mockNewConfig(t)
@@ -7,7 +7,10 @@ package godutch
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,12 +33,74 @@ type requestFields struct {
 // it's attributes.
 //
 type Response struct {
-	Name    string           `json:"name"`
-	Status  int              `json:"status"`
-	Stdout  []string         `json:"stdout"`
-	Metrics []map[string]int `json:"metrics,omitempty"`
-	Error   string           `json:"error,omitempty"`
-	Ts      int32            `json:"ts,omitempty"`
+	Name    string          `json:"name"`
+	Status  int             `json:"status"`
+	Stdout  []string        `json:"stdout"`
+	Metrics Metrics         `json:"metrics,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Ts      int32           `json:"ts,omitempty"`
+	Checks  []CheckMetadata `json:"checks,omitempty"`
+}
+
+//
+// A metric produced by a check, the value may be fractional, like latencies or
+// load averages. Timestamp (epoch seconds), unit and tags are optional, when
+// timestamp is not informed the response timestamp is used. Warning and
+// critical thresholds, minimum and maximum are rendered on Nagios performance
+// data.
+//
+type Metric struct {
+	Name  string            `json:"name"`
+	Value float64           `json:"value"`
+	Ts    int64             `json:"ts,omitempty"`
+	Unit  string            `json:"unit,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Warn  Threshold         `json:"warn,omitempty"`
+	Crit  Threshold         `json:"crit,omitempty"`
+	Min   Threshold         `json:"min,omitempty"`
+	Max   Threshold         `json:"max,omitempty"`
+}
+
+//
+// A threshold or boundary of a metric, informed by the check either as a
+// number or as a Nagios range string, like "10:20" or "@5".
+//
+type Threshold string
+
+//
+// Metrics carried by a Response. Besides a list of Metric objects, the original
+// form is accepted as well, a list of maps of metric name and value, like
+// '[{"okay": 1}]', and both forms may be mixed.
+//
+type Metrics []Metric
+
+//
+// Metadata a container advertises about one of it's checks, answering the
+// "__describe_checks" call. Interval and timeout are in seconds, and default
+// arguments are used when a check is requested without arguments.
+//
+type CheckMetadata struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description,omitempty"`
+	Arguments   []string         `json:"arguments,omitempty"`
+	Interval    int              `json:"interval,omitempty"`
+	Timeout     int              `json:"timeout,omitempty"`
+	Metrics     []MetricMetadata `json:"metrics,omitempty"`
+	Tags        []string         `json:"tags,omitempty"`
+}
+
+//
+// Name and unit of a metric produced by a check.
+//
+type MetricMetadata struct {
+	Name string `json:"name"`
+	Unit string `json:"unit,omitempty"`
+}
+
+// units of measurement understood by Nagios on performance data
+var nagiosUnits = map[string]bool{
+	"s": true, "ms": true, "us": true, "%": true, "B": true, "KB": true,
+	"MB": true, "GB": true, "TB": true, "c": true,
 }
 
 // Methods to be compliant with gonrpe.NrpeResponser interface, and therefore
@@ -52,6 +117,143 @@ func (resp *Response) GetStdout() []string {
 	return resp.Stdout
 }
 
+// Timestamp of the metric, or informed one when the metric does not carry it's
+// own timestamp.
+func (m Metric) Timestamp(ts int64) int64 {
+	if m.Ts > 0 {
+		return m.Ts
+	}
+	return ts
+}
+
+// Nagios performance data of the metric: "'label'=value[UOM];warn;crit;min;max",
+// trailing empty fields are omitted, and so are units Nagios doesn't know.
+func (m Metric) PerfData() string {
+	var fields []string = []string{
+		string(m.Warn), string(m.Crit), string(m.Min), string(m.Max)}
+	var perfData string = fmt.Sprintf("'%s'=%s",
+		strings.Replace(m.Name, "'", "''", -1),
+		strconv.FormatFloat(m.Value, 'f', -1, 64))
+
+	if nagiosUnits[m.Unit] {
+		perfData += m.Unit
+	}
+
+	for len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+
+	return strings.Join(append([]string{perfData}, fields...), ";")
+}
+
+// Decodes a threshold informed either as string or as number, numbers are kept
+// as written by the check.
+func (t *Threshold) UnmarshalJSON(payload []byte) error {
+	var str string
+	var number json.Number
+	var err error
+
+	if err = json.Unmarshal(payload, &str); err == nil {
+		*t = Threshold(str)
+		return nil
+	}
+
+	if err = json.Unmarshal(payload, &number); err != nil {
+		return fmt.Errorf("Invalid threshold: %s", string(payload))
+	}
+	*t = Threshold(number.String())
+
+	return nil
+}
+
+// Decodes metrics on both forms, items with a "name" string attribute are
+// Metric objects, otherwise they are maps of metric name and value, which are
+// sorted by name.
+func (metrics *Metrics) UnmarshalJSON(payload []byte) error {
+	var items []json.RawMessage
+	var item json.RawMessage
+	var fields map[string]json.RawMessage
+	var decoded Metrics
+	var metric Metric
+	var names []string
+	var name string
+	var err error
+
+	if err = json.Unmarshal(payload, &items); err != nil {
+		return err
+	}
+	if items == nil {
+		*metrics = nil
+		return nil
+	}
+
+	decoded = Metrics{}
+	for _, item = range items {
+		fields = nil
+		if err = json.Unmarshal(item, &fields); err != nil {
+			return fmt.Errorf("Invalid metric: %s", err)
+		}
+
+		if json.Unmarshal(fields["name"], &name) == nil {
+			metric = Metric{}
+			if err = json.Unmarshal(item, &metric); err != nil {
+				return fmt.Errorf("Invalid metric '%s': %s", name, err)
+			}
+			decoded = append(decoded, metric)
+			continue
+		}
+
+		names = names[:0]
+		for name = range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name = range names {
+			metric = Metric{Name: name}
+			if err = json.Unmarshal(fields[name], &metric.Value); err != nil {
+				return fmt.Errorf("Invalid metric '%s': %s", name, err)
+			}
+			decoded = append(decoded, metric)
+		}
+	}
+
+	*metrics = decoded
+	return nil
+}
+
+// Nagios performance data of all metrics, separated by spaces.
+func (resp *Response) PerfData() string {
+	var perfData []string
+	var metric Metric
+
+	for _, metric = range resp.Metrics {
+		perfData = append(perfData, metric.PerfData())
+	}
+
+	return strings.Join(perfData, " ")
+}
+
+// Returns a copy of the response with the performance data of it's metrics
+// after a "|" on the first line of output, as Nagios plugins do. Responses are
+// shared via cache, so the original is not changed.
+func (resp *Response) WithPerfData() *Response {
+	var withPerfData Response = *resp
+
+	if len(resp.Metrics) == 0 {
+		return resp
+	}
+
+	withPerfData.Stdout = append([]string{}, resp.Stdout...)
+	if len(withPerfData.Stdout) == 0 {
+		withPerfData.Stdout = []string{""}
+	}
+	withPerfData.Stdout[0] = fmt.Sprintf("%s | %s",
+		withPerfData.Stdout[0], resp.PerfData())
+
+	return &withPerfData
+}
+
 // Creates a slice of bytes that maches the JSON representation of informed
 // args, the straight forward input to a socket.
 func NewRequest(name string, args []string) (*Request, error) {
@@ -63,8 +265,8 @@ func NewRequest(name string, args []string) (*Request, error) {
 	var req *Request = &Request{Fields: reqFields}
 
 	if req.payload, err = json.Marshal(req.Fields); err != nil {
-		log.Fatalln("Error on JSON Marshal: ", err)
-		return nil, err
+		DefaultLogger().With("component", "Protocol").Debugf("Error on JSON Marshal: %s", err)
+		return nil, fmt.Errorf("%w: %s", ErrBadRequest, err)
 	}
 
 	req.payload = append(req.payload, []byte("\n")[0])
@@ -72,6 +274,24 @@ func NewRequest(name string, args []string) (*Request, error) {
 	return req, nil
 }
 
+// Creates a Request out of a slice of bytes, which is expected to be the JSON
+// representation of request fields, as produced by "NewRequest".
+func ParseRequest(payload []byte) (*Request, error) {
+	var err error
+	var reqFields requestFields
+
+	if err = json.Unmarshal(payload, &reqFields); err != nil {
+		DefaultLogger().With("component", "Protocol").Debugf("Error on request payload: %s", err)
+		return nil, fmt.Errorf("%w: %s", ErrBadRequest, err)
+	}
+
+	if reqFields.Arguments == nil {
+		reqFields.Arguments = []string{}
+	}
+
+	return NewRequest(reqFields.Command, reqFields.Arguments)
+}
+
 func (req *Request) ToBytes() []byte {
 	return req.payload
 }
@@ -83,9 +303,9 @@ func NewResponse(payload []byte) (*Response, error) {
 	var resp *Response = &Response{}
 
 	if err = json.Unmarshal(payload, resp); err != nil {
-		log.Fatalln("[Protocol] Error on payload: '",
-			string(payload[:]), "' returned error '", err)
-		return nil, err
+		DefaultLogger().With("component", "Protocol").Debugf("Error on payload '%s': %s",
+			string(payload[:]), err)
+		return nil, fmt.Errorf("%w: %s", ErrBadResponse, err)
 	}
 
 	// adding current timestamp on response
@@ -1,6 +1,8 @@
 package godutch_test
 
 import (
+	"encoding/json"
+	"errors"
 	. "github.com/otaviof/godutch"
 	. "github.com/smartystreets/goconvey/convey"
 	"testing"
@@ -19,6 +21,23 @@ func TestNewRequest(t *testing.T) {
 	})
 }
 
+func TestParseRequest(t *testing.T) {
+	var err error
+	var req *Request
+
+	Convey("Should be able to parse a Request payload", t, func() {
+		req, err = ParseRequest([]byte("{\"command\":\"test\",\"arguments\":[\"a\"]}"))
+		So(err, ShouldEqual, nil)
+		So(req.Fields.Command, ShouldEqual, "test")
+		So(req.Fields.Arguments, ShouldResemble, []string{"a"})
+	})
+
+	Convey("Should return error on invalid payload", t, func() {
+		_, err = ParseRequest([]byte("garbage"))
+		So(err, ShouldNotEqual, nil)
+	})
+}
+
 func TestNewResponseListCheckMethods(t *testing.T) {
 	var err error
 	var req []byte = []byte(
@@ -32,6 +51,32 @@ func TestNewResponseListCheckMethods(t *testing.T) {
 	})
 }
 
+func TestNewResponseDescribeChecks(t *testing.T) {
+	var err error
+	var payload []byte = []byte(
+		"{\"name\":\"__describe_checks\",\"stdout\":[],\"checks\":[" +
+			"{\"name\":\"check_test\",\"description\":\"Test check\"," +
+			"\"arguments\":[\"-w\",\"1\"],\"interval\":30,\"timeout\":5," +
+			"\"metrics\":[{\"name\":\"okay\",\"unit\":\"count\"}]," +
+			"\"tags\":[\"test\"]}]}")
+	var resp *Response
+
+	Convey("Should be able to new Response '__describe_checks'", t, func() {
+		resp, err = NewResponse(payload)
+		So(err, ShouldEqual, nil)
+		So(len(resp.Checks), ShouldEqual, 1)
+		So(resp.Checks[0], ShouldResemble, CheckMetadata{
+			Name:        "check_test",
+			Description: "Test check",
+			Arguments:   []string{"-w", "1"},
+			Interval:    30,
+			Timeout:     5,
+			Metrics:     []MetricMetadata{{Name: "okay", Unit: "count"}},
+			Tags:        []string{"test"},
+		})
+	})
+}
+
 func TestNewResponseCheckReturn(t *testing.T) {
 	Convey("Should be able to new Response 'check_test'", t, func() {
 		payload := []byte(
@@ -43,4 +88,93 @@ func TestNewResponseCheckReturn(t *testing.T) {
 	})
 }
 
+func TestNewResponseMetrics(t *testing.T) {
+	var resp *Response
+	var payload []byte
+	var err error
+
+	Convey("Should decode metrics as maps of name and value", t, func() {
+		resp, err = NewResponse([]byte(
+			"{\"name\":\"check_test\",\"metrics\":[{\"okay\":1,\"load\":0.5}]}"))
+		So(err, ShouldEqual, nil)
+		So(resp.Metrics, ShouldResemble, Metrics{
+			{Name: "load", Value: 0.5},
+			{Name: "okay", Value: 1},
+		})
+	})
+
+	Convey("Should decode metrics with timestamp, unit and tags", t, func() {
+		resp, err = NewResponse([]byte(
+			"{\"name\":\"check_test\",\"metrics\":[" +
+				"{\"name\":\"latency\",\"value\":12.5,\"ts\":1500000000," +
+				"\"unit\":\"ms\",\"tags\":{\"region\":\"eu\"}},{\"okay\":1}]}"))
+		So(err, ShouldEqual, nil)
+		So(resp.Metrics, ShouldResemble, Metrics{
+			{Name: "latency", Value: 12.5, Ts: 1500000000, Unit: "ms",
+				Tags: map[string]string{"region": "eu"}},
+			{Name: "okay", Value: 1},
+		})
+		So(resp.Metrics[0].Timestamp(1), ShouldEqual, 1500000000)
+		So(resp.Metrics[1].Timestamp(1), ShouldEqual, 1)
+	})
+
+	Convey("Should encode metrics as objects", t, func() {
+		payload, err = json.Marshal(resp.Metrics[1:])
+		So(err, ShouldEqual, nil)
+		So(string(payload), ShouldEqual, "[{\"name\":\"okay\",\"value\":1}]")
+	})
+
+	Convey("Should refuse metrics with invalid values", t, func() {
+		_, err = NewResponse([]byte(
+			"{\"name\":\"check_test\",\"metrics\":[{\"okay\":\"yes\"}]}"))
+		So(errors.Is(err, ErrBadResponse), ShouldBeTrue)
+	})
+}
+
+func TestResponsePerfData(t *testing.T) {
+	var resp *Response
+	var withPerfData *Response
+	var err error
+
+	Convey("Should decode thresholds as numbers or ranges", t, func() {
+		resp, err = NewResponse([]byte(
+			"{\"name\":\"check_test\",\"stdout\":[\"OK\",\"details\"]," +
+				"\"metrics\":[{\"name\":\"latency\",\"value\":12.5,\"unit\":\"ms\"," +
+				"\"warn\":100,\"crit\":\"@200:300\",\"min\":0}," +
+				"{\"name\":\"free space\",\"value\":42,\"unit\":\"count\"}]}"))
+		So(err, ShouldEqual, nil)
+		So(resp.Metrics[0].Warn, ShouldEqual, Threshold("100"))
+		So(resp.Metrics[0].Crit, ShouldEqual, Threshold("@200:300"))
+		So(resp.Metrics[0].Min, ShouldEqual, Threshold("0"))
+	})
+
+	Convey("Should render Nagios performance data", t, func() {
+		So(resp.Metrics[0].PerfData(), ShouldEqual, "'latency'=12.5ms;100;@200:300;0")
+		So(resp.Metrics[1].PerfData(), ShouldEqual, "'free space'=42")
+		So(resp.PerfData(), ShouldEqual,
+			"'latency'=12.5ms;100;@200:300;0 'free space'=42")
+	})
+
+	Convey("Should append performance data on the first line of a copy", t, func() {
+		withPerfData = resp.WithPerfData()
+		So(withPerfData.Stdout, ShouldResemble, []string{
+			"OK | 'latency'=12.5ms;100;@200:300;0 'free space'=42", "details"})
+		So(resp.Stdout, ShouldResemble, []string{"OK", "details"})
+	})
+
+	Convey("Should keep responses without metrics as they are", t, func() {
+		resp = &Response{Name: "check_test", Stdout: []string{"OK"}}
+		So(resp.WithPerfData(), ShouldEqual, resp)
+	})
+}
+
+func TestNewResponseGarbage(t *testing.T) {
+	var err error
+
+	Convey("Should return ErrBadResponse on garbage payload", t, func() {
+		_, err = NewResponse([]byte("garbage"))
+		So(errors.Is(err, ErrBadResponse), ShouldBeTrue)
+	})
+}
+
 /* EOF */
@@ -0,0 +1,225 @@
+package godutch
+
+//
+// Scheduler runs the checks automatically, following each check's interval,
+// with a random jitter added, to spread the load. Checks are executed on a
+// bounded pool of workers, and a check never overlaps with itself.
+//
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// default amount of workers executing scheduled checks
+	SCHEDULER_DEFAULT_WORKERS = 4
+	// how often the scheduler looks for checks that are due
+	SCHEDULER_TICK = time.Second
+)
+
+//
+// Schedule of a check, interval between runs and maximum random delay added on
+// top of it.
+//
+type CheckSchedule struct {
+	Interval time.Duration `json:"interval"`
+	Jitter   time.Duration `json:"jitter"`
+}
+
+//
+// Scheduler type, holds Panamax to find and execute checks, and bookkeeping of
+// running checks and their jitter.
+//
+type Scheduler struct {
+	p               *Panamax
+	workers         int
+	defaultInterval time.Duration
+	mutex           sync.Mutex
+	running         map[string]bool
+	attempt         map[string]time.Time
+	delay           map[string]time.Duration
+	jobs            chan string
+	stopCh          chan struct{}
+	wg              sync.WaitGroup
+	logger          *Logger
+}
+
+// Creates a new scheduler, default interval is used for checks without their
+// own interval, zero disables it.
+func NewScheduler(p *Panamax, workers int, defaultInterval time.Duration) *Scheduler {
+	var s *Scheduler
+
+	if workers <= 0 {
+		workers = SCHEDULER_DEFAULT_WORKERS
+	}
+
+	s = &Scheduler{
+		p:               p,
+		workers:         workers,
+		defaultInterval: defaultInterval,
+		running:         make(map[string]bool),
+		attempt:         make(map[string]time.Time),
+		delay:           make(map[string]time.Duration),
+		jobs:            make(chan string, workers),
+		stopCh:          make(chan struct{}),
+		logger:          p.logger.With("component", "Scheduler"),
+	}
+
+	return s
+}
+
+// Starts the workers, and periodically look for checks that are due, until
+// stopped. Intended to run in background.
+func (s *Scheduler) Serve() {
+	var i int
+	var ticker *time.Ticker = time.NewTicker(SCHEDULER_TICK)
+
+	defer ticker.Stop()
+
+	s.mutex.Lock()
+	s.logger.Infof("Starting '%d' workers, default interval: %s",
+		s.workers, s.defaultInterval)
+	s.mutex.Unlock()
+
+	for i = 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			s.dispatch()
+		case <-s.stopCh:
+			close(s.jobs)
+			s.wg.Wait()
+			return
+		}
+	}
+}
+
+// Replaces the interval of checks without their own interval, used when the
+// last-run threshold of services changes on reload. Zero disables it.
+func (s *Scheduler) SetDefaultInterval(defaultInterval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.defaultInterval != defaultInterval {
+		s.logger.Infof("Default interval: from %s to %s",
+			s.defaultInterval, defaultInterval)
+	}
+	s.defaultInterval = defaultInterval
+}
+
+// Stop the scheduler, no more checks are handed over to the workers. Returns
+// right away, checks already running finish in background, and Serve returns
+// once they are done.
+func (s *Scheduler) Stop() {
+	close(s.stopCh)
+}
+
+// Looks for checks that are due and hand them over to the workers. Checks that
+// are still running, or that can't find a idle worker, wait for the next tick.
+func (s *Scheduler) dispatch() {
+	var name string
+	var schedule CheckSchedule
+	var interval time.Duration
+	var elapsed time.Duration
+	var lastRun int64
+	var found bool
+	var attempt time.Time
+	var defaultInterval time.Duration
+
+	s.mutex.Lock()
+	defaultInterval = s.defaultInterval
+	s.mutex.Unlock()
+
+	for name, schedule = range s.p.Schedules() {
+		if interval = schedule.Interval; interval <= 0 {
+			interval = defaultInterval
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		s.mutex.Lock()
+		if s.running[name] {
+			s.mutex.Unlock()
+			continue
+		}
+
+		// checks seen for the first time are due right away, plus jitter
+		if attempt, found = s.attempt[name]; !found {
+			attempt = time.Now().Add(-interval)
+			s.attempt[name] = attempt
+			s.delay[name] = jitter(schedule.Jitter)
+		}
+
+		// elapsed time since the last attempt, or last run, which considers
+		// also executions not triggered by the scheduler, like NRPE requests
+		elapsed = time.Since(attempt)
+		if lastRun = s.p.CheckLastRun(name); lastRun >= 0 {
+			if time.Duration(lastRun)*time.Second < elapsed {
+				elapsed = time.Duration(lastRun) * time.Second
+			}
+		}
+
+		if elapsed < interval+s.delay[name] {
+			s.mutex.Unlock()
+			continue
+		}
+
+		select {
+		case s.jobs <- name:
+			s.running[name] = true
+			s.attempt[name] = time.Now()
+			s.delay[name] = jitter(schedule.Jitter)
+		default:
+			// pool saturation is expected under load, checks wait a tick
+			s.logger.With("check", name).Debugf(
+				"No idle workers for '%s', waiting.", name)
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Executes the checks handed over by the scheduler.
+func (s *Scheduler) worker() {
+	var name string
+	var req *Request
+	var start time.Time
+	var err error
+
+	defer s.wg.Done()
+
+	for name = range s.jobs {
+		start = time.Now()
+		if req, err = NewRequest(name, []string{}); err == nil {
+			_, err = s.p.Execute(req)
+		}
+
+		if err != nil {
+			s.logger.With("check", name).Errorf(
+				"Error on executing '%s': %s", name, err)
+		} else {
+			s.logger.With("check", name).With("duration", time.Since(start)).Infof(
+				"Executed '%s'", name)
+		}
+
+		s.mutex.Lock()
+		delete(s.running, name)
+		s.mutex.Unlock()
+	}
+}
+
+// Returns a random duration between zero and informed maximum.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+/* EOF */
@@ -0,0 +1,77 @@
+package godutch_test
+
+import (
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig(
+		"scheduled", "check_often", "check_rarely")
+	var s *Scheduler
+	var err error
+
+	cfg.Interval = 3600
+	cfg.CheckInterval = []string{"check_often:1"}
+
+	Convey("Should load a helper container on Panamax", t, func() {
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+	})
+	defer p.Unload("scheduled")
+
+	Convey("Should follow check specific intervals", t, func() {
+		So(p.Schedules()["check_often"].Interval, ShouldEqual, time.Second)
+		So(p.Schedules()["check_rarely"].Interval, ShouldEqual, time.Hour)
+	})
+
+	s = NewScheduler(p, 2, 0)
+	go s.Serve()
+
+	Convey("Should run checks on schedule", t, func() {
+		time.Sleep(1500 * time.Millisecond)
+		So(p.CheckLastRun("check_often"), ShouldBeGreaterThanOrEqualTo, 0)
+		So(p.CheckLastRun("check_rarely"), ShouldBeGreaterThanOrEqualTo, 0)
+
+		// only the check with short interval runs again
+		time.Sleep(3 * time.Second)
+		So(p.CheckLastRun("check_often"), ShouldBeLessThanOrEqualTo, 2)
+		So(p.CheckLastRun("check_rarely"), ShouldBeGreaterThanOrEqualTo, 3)
+	})
+
+	s.Stop()
+}
+
+func TestSchedulerDefaultInterval(t *testing.T) {
+	var p *Panamax = mockPanamax(t)
+	var cfg *ContainerConfig = mockHelperContainerConfig(
+		"unscheduled", "check_unscheduled")
+	var s *Scheduler
+	var err error
+
+	Convey("Should load a helper container without intervals", t, func() {
+		err = p.Load(cfg)
+		So(err, ShouldEqual, nil)
+	})
+	defer p.Unload("unscheduled")
+
+	s = NewScheduler(p, 1, 0)
+	go s.Serve()
+	defer s.Stop()
+
+	Convey("Should not run checks without default interval", t, func() {
+		time.Sleep(1500 * time.Millisecond)
+		So(p.CheckLastRun("check_unscheduled"), ShouldEqual, -1)
+	})
+
+	Convey("Should run checks once a default interval is set", t, func() {
+		s.SetDefaultInterval(time.Second)
+		time.Sleep(1500 * time.Millisecond)
+		So(p.CheckLastRun("check_unscheduled"), ShouldBeGreaterThanOrEqualTo, 0)
+	})
+}
+
+/* EOF */
@@ -0,0 +1,328 @@
+package godutch
+
+//
+// Implements a service that reads check responses from local cache and publish
+// them as Sensu check results. It can either talk to a local Sensu agent
+// socket, using JSON over TCP or UDP, or to a HTTP events end-point.
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gocache "github.com/patrickmn/go-cache"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timeout for network operations
+	SENSU_TIMEOUT = 10 * time.Second
+)
+
+type SensuService struct {
+	cfg   *ServiceConfig
+	cache *gocache.Cache
+	// mapping the responses that are already published with their respective
+	// timestamp, to avoid duplication
+	sentResult map[string]int32
+	client     *http.Client
+	DialOn     []string
+	stopCh     chan struct{}
+	// results are published by one caller at a time
+	mutex  sync.Mutex
+	logger *Logger
+}
+
+//
+// Check result as expected by the Sensu agent socket, metrics are informed
+// as a custom attribute.
+//
+type sensuCheckResult struct {
+	Name     string        `json:"name"`
+	Status   int           `json:"status"`
+	Output   string        `json:"output"`
+	Source   string        `json:"source,omitempty"`
+	Executed int64         `json:"executed"`
+	Interval int64         `json:"interval,omitempty"`
+	Metrics  []sensuMetric `json:"metrics,omitempty"`
+}
+
+type sensuMetric struct {
+	Name      string           `json:"name"`
+	Value     float64          `json:"value"`
+	Timestamp int64            `json:"timestamp"`
+	Tags      []sensuMetricTag `json:"tags,omitempty"`
+}
+
+type sensuMetricTag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+//
+// Event as expected by the HTTP events end-point.
+//
+type sensuEvent struct {
+	Check   sensuEventCheck    `json:"check"`
+	Metrics *sensuEventMetrics `json:"metrics,omitempty"`
+}
+
+type sensuEventCheck struct {
+	Metadata sensuEventMetadata `json:"metadata"`
+	Status   int                `json:"status"`
+	Output   string             `json:"output"`
+	Executed int64              `json:"executed"`
+	Interval int64              `json:"interval,omitempty"`
+}
+
+type sensuEventMetadata struct {
+	Name string `json:"name"`
+}
+
+type sensuEventMetrics struct {
+	Points []sensuMetric `json:"points"`
+}
+
+// Creates a new instance of SensuService, which takes a cache object to look for
+// check responses.
+func NewSensuService(cfg *ServiceConfig, cache *gocache.Cache) *SensuService {
+	var ss *SensuService
+	ss = &SensuService{
+		cfg:        cfg,
+		cache:      cache,
+		sentResult: make(map[string]int32),
+		client:     &http.Client{Timeout: SENSU_TIMEOUT},
+		DialOn:     cfg.ParseDialOn(),
+		stopCh:     make(chan struct{}),
+		logger:     DefaultLogger().With("component", "Sensu"),
+	}
+	return ss
+}
+
+// Replaces the logger.
+func (ss *SensuService) SetLogger(l *Logger) {
+	ss.logger = l.With("component", "Sensu")
+}
+
+// Takes over the results already published by the service being replaced, so
+// they are not published again.
+func (ss *SensuService) inheritSent(old *SensuService) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+	copySent(ss.sentResult, old.sentResult)
+}
+
+// Publishes pending check results, using the configured end-points
+// sequentially, until one of them accepts the results.
+func (ss *SensuService) Send() error {
+	var err error
+	var pending map[string]*Response
+	var dialStr string
+	var name string
+	var resp *Response
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if pending = pendingResponses(ss.cache, ss.sentResult, ss.logger); len(pending) == 0 {
+		ss.logger.Debugf("No check results to be sent, skipping.")
+		return nil
+	}
+
+	for _, dialStr = range ss.DialOn {
+		ss.logger.Infof("Publishing '%d' result(s) towards '%s'",
+			len(pending), dialStr)
+
+		if err = ss.publish(dialStr, pending); err != nil {
+			ss.logger.Errorf("Error on publishing to '%s': %s", dialStr, err)
+			continue
+		}
+
+		// results are delivered, marking them as sent
+		for name, resp = range pending {
+			ss.sentResult[name] = resp.Ts
+		}
+
+		ss.logger.Infof("Check results sent!")
+		return nil
+	}
+
+	if err == nil {
+		err = errors.New("[Sensu] No end-points to dial on.")
+	}
+	ss.logger.Errorf("No more hosts to try.")
+
+	return err
+}
+
+// Publishes check results on a single end-point, the dial-string scheme defines
+// the transport: "http://" and "https://" for events end-point, "udp://" for
+// agent socket over UDP, and "tcp://" (or no scheme) for agent socket over TCP.
+func (ss *SensuService) publish(dialStr string, pending map[string]*Response) error {
+	var err error
+	var resp *Response
+
+	for _, resp = range pending {
+		switch {
+		case strings.HasPrefix(dialStr, "http://"),
+			strings.HasPrefix(dialStr, "https://"):
+			err = ss.postEvent(dialStr, resp)
+		case strings.HasPrefix(dialStr, "udp://"):
+			err = ss.writeSocket("udp", strings.TrimPrefix(dialStr, "udp://"), resp)
+		default:
+			err = ss.writeSocket("tcp", strings.TrimPrefix(dialStr, "tcp://"), resp)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes a check result as JSON on Sensu agent socket, a connection per check
+// result is used.
+func (ss *SensuService) writeSocket(network string, address string, resp *Response) error {
+	var err error
+	var conn net.Conn
+	var payload []byte
+
+	if payload, err = json.Marshal(ss.checkResult(resp)); err != nil {
+		return err
+	}
+
+	if conn, err = net.DialTimeout(network, address, SENSU_TIMEOUT); err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(SENSU_TIMEOUT)); err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(payload); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Posts a check result as a JSON event on HTTP end-point.
+func (ss *SensuService) postEvent(url string, resp *Response) error {
+	var err error
+	var payload []byte
+	var httpResp *http.Response
+
+	if payload, err = json.Marshal(ss.event(resp)); err != nil {
+		return err
+	}
+
+	if httpResp, err = ss.client.Post(
+		url, "application/json", bytes.NewReader(payload)); err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		return fmt.Errorf("[Sensu] HTTP end-point returned: '%s'",
+			httpResp.Status)
+	}
+
+	return nil
+}
+
+// Transforms a Response into a check result for Sensu agent socket.
+func (ss *SensuService) checkResult(resp *Response) *sensuCheckResult {
+	return &sensuCheckResult{
+		Name:     resp.Name,
+		Status:   resp.Status,
+		Output:   strings.Join(resp.Stdout, "\n"),
+		Source:   ss.cfg.HostName,
+		Executed: int64(resp.Ts),
+		Interval: ss.cfg.LastRunThreshold,
+		Metrics:  ss.metrics(resp),
+	}
+}
+
+// Transforms a Response into a event for the HTTP end-point.
+func (ss *SensuService) event(resp *Response) *sensuEvent {
+	var event *sensuEvent = &sensuEvent{
+		Check: sensuEventCheck{
+			Metadata: sensuEventMetadata{Name: resp.Name},
+			Status:   resp.Status,
+			Output:   strings.Join(resp.Stdout, "\n"),
+			Executed: int64(resp.Ts),
+			Interval: ss.cfg.LastRunThreshold,
+		},
+	}
+
+	if len(resp.Metrics) > 0 {
+		event.Metrics = &sensuEventMetrics{Points: ss.metrics(resp)}
+	}
+
+	return event
+}
+
+// Extracts the metrics of a Response, name is prefixed by check name. Tags are
+// sorted by name, and the unit is informed as "unit" tag.
+func (ss *SensuService) metrics(resp *Response) []sensuMetric {
+	var metric Metric
+	var tagNames []string
+	var tagName string
+	var tags []sensuMetricTag
+	var metrics []sensuMetric
+
+	for _, metric = range resp.Metrics {
+		tagNames = nil
+		for tagName = range metric.Tags {
+			tagNames = append(tagNames, tagName)
+		}
+		sort.Strings(tagNames)
+
+		tags = nil
+		for _, tagName = range tagNames {
+			tags = append(tags, sensuMetricTag{
+				Name: tagName, Value: metric.Tags[tagName]})
+		}
+		if metric.Unit != "" {
+			tags = append(tags, sensuMetricTag{Name: "unit", Value: metric.Unit})
+		}
+
+		metrics = append(metrics, sensuMetric{
+			Name:      fmt.Sprintf("%s.%s", resp.Name, metric.Name),
+			Value:     metric.Value,
+			Timestamp: metric.Timestamp(int64(resp.Ts)),
+			Tags:      tags,
+		})
+	}
+
+	return metrics
+}
+
+// Here on Sensu, the "serve" method looks at local cache periodically and
+// publish the check results by calling "send" method locally. Intended to run
+// in background, until stopped.
+func (ss *SensuService) Serve() {
+	for {
+		select {
+		case <-time.After(10 * time.Second):
+			ss.Send()
+		case <-ss.stopCh:
+			return
+		}
+	}
+}
+
+// Stop publishing check results, interrupting the "serve" loop.
+func (ss *SensuService) Stop() {
+	close(ss.stopCh)
+}
+
+/* EOF */
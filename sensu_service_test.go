@@ -0,0 +1,172 @@
+package godutch_test
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/otaviof/godutch"
+	gocache "github.com/patrickmn/go-cache"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Stand-in for Sensu agent TCP socket, each connection carries a single JSON
+// check result, sent back via channel.
+func mockSensuSocket(t *testing.T) (net.Listener, chan map[string]interface{}) {
+	var err error
+	var listener net.Listener
+	var results chan map[string]interface{} = make(chan map[string]interface{}, 10)
+
+	if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		var conn net.Conn
+		var payload []byte
+		var result map[string]interface{}
+
+		for {
+			if conn, err = listener.Accept(); err != nil {
+				return
+			}
+			payload, _ = ioutil.ReadAll(conn)
+			conn.Close()
+
+			result = make(map[string]interface{})
+			json.Unmarshal(payload, &result)
+			results <- result
+		}
+	}()
+
+	return listener, results
+}
+
+func TestSensuServiceSocket(t *testing.T) {
+	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["sensuclient"]
+	var listener net.Listener
+	var results chan map[string]interface{}
+	var result map[string]interface{}
+	var ss *SensuService
+	var err error
+
+	listener, results = mockSensuSocket(t)
+	defer listener.Close()
+
+	sc.DialOn = fmt.Sprintf("tcp://%s", listener.Addr().String())
+	ss = NewSensuService(&sc, populatedCache())
+
+	Convey("Should publish check results on agent socket", t, func() {
+		err = ss.Send()
+		So(err, ShouldEqual, nil)
+
+		result = <-results
+		So(result["name"], ShouldEqual, "check_test")
+		So(result["status"], ShouldEqual, 0)
+		So(result["output"], ShouldEqual, "Mocked")
+		So(result["source"], ShouldEqual, "godutch.local")
+		So(len(result["metrics"].([]interface{})), ShouldEqual, 1)
+	})
+}
+
+func TestSensuServiceHTTP(t *testing.T) {
+	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["sensuclient"]
+	var events chan map[string]interface{} = make(chan map[string]interface{}, 10)
+	var server *httptest.Server
+	var event map[string]interface{}
+	var check map[string]interface{}
+	var ss *SensuService
+	var err error
+
+	server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var event map[string]interface{} = make(map[string]interface{})
+			json.NewDecoder(r.Body).Decode(&event)
+			events <- event
+			w.WriteHeader(http.StatusAccepted)
+		}))
+	defer server.Close()
+
+	// first end-point is not listening, the second is the stand-in server
+	sc.DialOn = fmt.Sprintf("127.0.0.1:1, %s/events", server.URL)
+	ss = NewSensuService(&sc, populatedCache())
+
+	Convey("Should publish check results as events on HTTP end-point", t, func() {
+		err = ss.Send()
+		So(err, ShouldEqual, nil)
+
+		event = <-events
+		check = event["check"].(map[string]interface{})
+		So(check["metadata"], ShouldResemble,
+			map[string]interface{}{"name": "check_test"})
+		So(check["output"], ShouldEqual, "Mocked")
+		So(event["metrics"], ShouldNotBeNil)
+	})
+
+	Convey("Should not publish the same check result twice", t, func() {
+		err = ss.Send()
+		So(err, ShouldEqual, nil)
+		So(len(events), ShouldEqual, 0)
+	})
+}
+
+func TestSensuServiceMetrics(t *testing.T) {
+	var cfg *Config = mockNewConfig(t)
+	var sc ServiceConfig = *cfg.Service["sensuclient"]
+	var cache *gocache.Cache = gocache.New(time.Minute, 20*time.Second)
+	var listener net.Listener
+	var results chan map[string]interface{}
+	var result map[string]interface{}
+	var metrics []interface{}
+	var ss *SensuService
+	var err error
+
+	listener, results = mockSensuSocket(t)
+	defer listener.Close()
+
+	cache.Set("check_latency", &Response{
+		Name:   "check_latency",
+		Stdout: []string{"Mocked"},
+		Ts:     1500000000,
+		Metrics: Metrics{
+			{Name: "latency", Value: 12.5, Unit: "ms",
+				Tags: map[string]string{"region": "eu", "host": "web01"}},
+			{Name: "load", Value: 0.75, Ts: 1400000000},
+		},
+	}, gocache.DefaultExpiration)
+
+	sc.DialOn = fmt.Sprintf("tcp://%s", listener.Addr().String())
+	ss = NewSensuService(&sc, cache)
+
+	Convey("Should publish fractional metrics with tags and units", t, func() {
+		err = ss.Send()
+		So(err, ShouldEqual, nil)
+
+		result = <-results
+		metrics = result["metrics"].([]interface{})
+		So(len(metrics), ShouldEqual, 2)
+		So(metrics[0], ShouldResemble, map[string]interface{}{
+			"name":      "check_latency.latency",
+			"value":     12.5,
+			"timestamp": float64(1500000000),
+			"tags": []interface{}{
+				map[string]interface{}{"name": "host", "value": "web01"},
+				map[string]interface{}{"name": "region", "value": "eu"},
+				map[string]interface{}{"name": "unit", "value": "ms"},
+			},
+		})
+		So(metrics[1], ShouldResemble, map[string]interface{}{
+			"name":      "check_latency.load",
+			"value":     0.75,
+			"timestamp": float64(1400000000),
+		})
+	})
+}
+
+/* EOF */
@@ -0,0 +1,106 @@
+package godutch
+
+//
+// TLS settings of network services. A certificate and key can be informed on
+// service configuration, otherwise an ephemeral self-signed certificate is
+// generated on startup. When a CA is informed, clients must present a
+// certificate signed by it (mutual TLS).
+//
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	// validity of ephemeral self-signed certificates
+	TLS_EPHEMERAL_CERT_VALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+// Creates the TLS configuration of a service, out of "ssl_cert", "ssl_key" and
+// "ssl_ca" settings.
+func (sc *ServiceConfig) TLSConfig() (*tls.Config, error) {
+	var tlsCfg *tls.Config = &tls.Config{MinVersion: tls.VersionTLS12}
+	var cert tls.Certificate
+	var pem []byte
+	var err error
+
+	switch {
+	case sc.SslCert != "" && sc.SslKey != "":
+		if cert, err = tls.LoadX509KeyPair(sc.SslCert, sc.SslKey); err != nil {
+			return nil, fmt.Errorf("Error on loading certificate: %s", err)
+		}
+	case sc.SslCert != "" || sc.SslKey != "":
+		return nil, errors.New("Both 'ssl_cert' and 'ssl_key' must be informed")
+	default:
+		if cert, err = selfSignedCertificate(); err != nil {
+			return nil, fmt.Errorf("Error on generating certificate: %s", err)
+		}
+	}
+	tlsCfg.Certificates = []tls.Certificate{cert}
+
+	if sc.SslCa != "" {
+		if pem, err = ioutil.ReadFile(sc.SslCa); err != nil {
+			return nil, fmt.Errorf("Error on reading CA: %s", err)
+		}
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		if !tlsCfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found on CA: '%s'", sc.SslCa)
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// Generates a self-signed certificate for the local host name, kept only in
+// memory, clients are not able to verify it.
+func selfSignedCertificate() (tls.Certificate, error) {
+	var key *ecdsa.PrivateKey
+	var serial *big.Int
+	var hostName string
+	var template x509.Certificate
+	var der []byte
+	var err error
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if hostName, err = os.Hostname(); err != nil {
+		hostName = "localhost"
+	}
+
+	template = x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostName, Organization: []string{"GoDutch"}},
+		DNSNames:     []string{hostName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(TLS_EPHEMERAL_CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if der, err = x509.CreateCertificate(
+		rand.Reader, &template, &template, &key.PublicKey, key); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+/* EOF */
@@ -0,0 +1,158 @@
+package godutch_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//
+// Certificates and keys written on a temporary directory: a CA, a server and a
+// client certificate signed by it.
+//
+type mockPKI struct {
+	dir        string
+	caCert     string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+}
+
+// Issues a certificate signed by parent, or self-signed when parent is nil,
+// writing certificate and key as PEM files named after informed name.
+func mockIssueCertificate(
+	t *testing.T,
+	dir string,
+	name string,
+	template *x509.Certificate,
+	parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	var key *ecdsa.PrivateKey
+	var keyDer []byte
+	var der []byte
+	var cert *x509.Certificate
+	var err error
+
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if der, err = x509.CreateCertificate(
+		rand.Reader, template, parent, &key.PublicKey, parentKey); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	if keyDer, err = x509.MarshalECPrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return cert, key
+}
+
+// Creates a CA, and server and client certificates signed by it.
+func mockNewPKI(t *testing.T) *mockPKI {
+	var dir string
+	var ca *x509.Certificate
+	var caKey *ecdsa.PrivateKey
+	var err error
+
+	if dir, err = ioutil.TempDir("", "godutch-pki"); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, caKey = mockIssueCertificate(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	mockIssueCertificate(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	mockIssueCertificate(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	return &mockPKI{
+		dir:        dir,
+		caCert:     filepath.Join(dir, "ca.crt"),
+		serverCert: filepath.Join(dir, "server.crt"),
+		serverKey:  filepath.Join(dir, "server.key"),
+		clientCert: filepath.Join(dir, "client.crt"),
+		clientKey:  filepath.Join(dir, "client.key"),
+	}
+}
+
+func TestServiceTLSConfig(t *testing.T) {
+	var pki *mockPKI = mockNewPKI(t)
+	var sc *ServiceConfig
+	var tlsCfg *tls.Config
+	var err error
+
+	defer os.RemoveAll(pki.dir)
+
+	Convey("Should generate a self-signed certificate when not informed", t, func() {
+		sc = &ServiceConfig{Ssl: true}
+		tlsCfg, err = sc.TLSConfig()
+		So(err, ShouldEqual, nil)
+		So(len(tlsCfg.Certificates), ShouldEqual, 1)
+		So(tlsCfg.ClientAuth, ShouldEqual, tls.NoClientCert)
+	})
+
+	Convey("Should load certificate and require clients signed by CA", t, func() {
+		sc = &ServiceConfig{Ssl: true, SslCert: pki.serverCert,
+			SslKey: pki.serverKey, SslCa: pki.caCert}
+		tlsCfg, err = sc.TLSConfig()
+		So(err, ShouldEqual, nil)
+		So(tlsCfg.ClientAuth, ShouldEqual, tls.RequireAndVerifyClientCert)
+	})
+
+	Convey("Should refuse a certificate without key", t, func() {
+		sc = &ServiceConfig{Ssl: true, SslCert: pki.serverCert}
+		_, err = sc.TLSConfig()
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should refuse a CA without certificates", t, func() {
+		sc = &ServiceConfig{Ssl: true, SslCa: pki.serverKey}
+		_, err = sc.TLSConfig()
+		So(err, ShouldNotEqual, nil)
+		So(err.Error(), ShouldContainSubstring, fmt.Sprintf("'%s'", pki.serverKey))
+	})
+}
+
+/* EOF */
@@ -0,0 +1,163 @@
+package godutch
+
+//
+// Transport is the way GoDutch reaches a container's background command, a
+// UNIX socket by default, or a TCP port on loopback interface for platforms
+// without proper AF_UNIX support. TCP ports are allocated out of a range.
+//
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// environment variables informing the background command where to listen
+	TRANSPORT_UNIX_ENV = "GODUTCH_SOCKET_PATH"
+	TRANSPORT_TCP_ENV  = "GODUTCH_TCP_ADDRESS"
+	// interface TCP ports are allocated on
+	TRANSPORT_TCP_HOST = "127.0.0.1"
+)
+
+//
+// Network and address a container listens on, plus the TCP port when on TCP.
+//
+type Transport struct {
+	Network string
+	Address string
+	Port    int
+}
+
+//
+// Range of TCP ports, keeping track of ports in use by containers.
+//
+type PortRange struct {
+	mutex sync.Mutex
+	first int
+	last  int
+	used  map[int]bool
+}
+
+// Creates a UNIX socket transport for the container, on it's socket directory.
+func NewUnixTransport(cfg *ContainerConfig) *Transport {
+	var socketName string = fmt.Sprintf("godutch-%s.sock", cfg.Name)
+	return &Transport{
+		Network: "unix",
+		Address: filepath.Join(cfg.SocketDir, socketName),
+	}
+}
+
+// Creates a TCP transport on loopback interface, using informed port.
+func NewTCPTransport(port int) *Transport {
+	return &Transport{
+		Network: "tcp",
+		Address: net.JoinHostPort(TRANSPORT_TCP_HOST, strconv.Itoa(port)),
+		Port:    port,
+	}
+}
+
+// Dials to the container.
+func (t *Transport) Dial() (net.Conn, error) {
+	return net.Dial(t.Network, t.Address)
+}
+
+// Name of the environment variable informing the address to the background
+// command.
+func (t *Transport) EnvName() string {
+	if t.Network == "tcp" {
+		return TRANSPORT_TCP_ENV
+	}
+	return TRANSPORT_UNIX_ENV
+}
+
+// Removes the UNIX socket file, when it exists. Nothing to do for TCP.
+func (t *Transport) Cleanup() error {
+	var okay bool
+	var logger *Logger
+	var err error
+
+	if t.Network != "unix" {
+		return nil
+	}
+
+	if okay, _ = exists(t.Address); !okay {
+		return nil
+	}
+
+	logger = DefaultLogger().With("component", "Transport")
+	logger.Infof("Removing socket: '%s'", t.Address)
+	if err = os.Remove(t.Address); err != nil {
+		logger.Errorf("Error on removing socket: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// Creates a port range out of a "first-last" string, like "11111-11333".
+func NewPortRange(portsRange string) (*PortRange, error) {
+	var firstLast []string = strings.SplitN(portsRange, "-", 2)
+	var pr *PortRange = &PortRange{used: make(map[int]bool)}
+	var err error
+
+	if len(firstLast) != 2 {
+		return nil, errors.New("Invalid TCP ports range: " + portsRange)
+	}
+
+	if pr.first, err = strconv.Atoi(strings.TrimSpace(firstLast[0])); err != nil {
+		return nil, errors.New("Invalid TCP ports range: " + portsRange)
+	}
+	if pr.last, err = strconv.Atoi(strings.TrimSpace(firstLast[1])); err != nil {
+		return nil, errors.New("Invalid TCP ports range: " + portsRange)
+	}
+
+	if pr.first <= 0 || pr.last > 65535 || pr.first > pr.last {
+		return nil, errors.New("Invalid TCP ports range: " + portsRange)
+	}
+
+	return pr, nil
+}
+
+// Allocates a port which is not in use by other containers, and is free on
+// loopback interface at this moment.
+func (pr *PortRange) Allocate() (int, error) {
+	var port int
+	var listener net.Listener
+	var err error
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+
+	for port = pr.first; port <= pr.last; port++ {
+		if pr.used[port] {
+			continue
+		}
+		// making sure nothing else is listening on this port
+		if listener, err = net.Listen("tcp", net.JoinHostPort(
+			TRANSPORT_TCP_HOST, strconv.Itoa(port))); err != nil {
+			DefaultLogger().With("component", "Transport").Warnf("Port '%d' is not available: %s", port, err)
+			continue
+		}
+		listener.Close()
+
+		pr.used[port] = true
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("No free TCP port on range %d-%d", pr.first, pr.last)
+}
+
+// Releases a port, so it can be allocated again.
+func (pr *PortRange) Release(port int) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	delete(pr.used, port)
+}
+
+/* EOF */
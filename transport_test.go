@@ -0,0 +1,81 @@
+package godutch_test
+
+import (
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"testing"
+)
+
+func TestNewPortRange(t *testing.T) {
+	var err error
+
+	Convey("Should parse a valid range", t, func() {
+		_, err = NewPortRange("11111-11333")
+		So(err, ShouldEqual, nil)
+	})
+
+	Convey("Should return error on invalid ranges", t, func() {
+		for _, portsRange := range []string{"", "11111", "a-b", "2-1", "1-70000"} {
+			_, err = NewPortRange(portsRange)
+			So(err, ShouldNotEqual, nil)
+		}
+	})
+}
+
+func TestPortRangeAllocate(t *testing.T) {
+	var pr *PortRange
+	var listener net.Listener
+	var port int
+	var err error
+
+	pr, _ = NewPortRange("22211-22213")
+
+	// the first port is taken by someone else
+	if listener, err = net.Listen("tcp", "127.0.0.1:22211"); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	Convey("Should skip ports in use on loopback interface", t, func() {
+		port, err = pr.Allocate()
+		So(err, ShouldEqual, nil)
+		So(port, ShouldEqual, 22212)
+	})
+
+	Convey("Should not allocate the same port twice", t, func() {
+		port, err = pr.Allocate()
+		So(err, ShouldEqual, nil)
+		So(port, ShouldEqual, 22213)
+		_, err = pr.Allocate()
+		So(err, ShouldNotEqual, nil)
+	})
+
+	Convey("Should allocate released ports again", t, func() {
+		pr.Release(22212)
+		port, err = pr.Allocate()
+		So(err, ShouldEqual, nil)
+		So(port, ShouldEqual, 22212)
+	})
+}
+
+func TestTransport(t *testing.T) {
+	var cfg *ContainerConfig = &ContainerConfig{Name: "test", SocketDir: "/tmp"}
+	var tr *Transport
+
+	Convey("Should create a UNIX socket transport on socket dir", t, func() {
+		tr = NewUnixTransport(cfg)
+		So(tr.Network, ShouldEqual, "unix")
+		So(tr.Address, ShouldEqual, "/tmp/godutch-test.sock")
+		So(tr.EnvName(), ShouldEqual, "GODUTCH_SOCKET_PATH")
+	})
+
+	Convey("Should create a TCP transport on loopback", t, func() {
+		tr = NewTCPTransport(11111)
+		So(tr.Network, ShouldEqual, "tcp")
+		So(tr.Address, ShouldEqual, "127.0.0.1:11111")
+		So(tr.EnvName(), ShouldEqual, "GODUTCH_TCP_ADDRESS")
+	})
+}
+
+/* EOF */
@@ -0,0 +1,107 @@
+package godutch
+
+//
+// Watcher looks for changes on configuration directories, where containers and
+// services INI files live, and reloads the configuration once the changes
+// settle down, using the same path as a manual reload.
+//
+
+import (
+	"time"
+)
+
+const (
+	// default amount of seconds without changes before reloading
+	WATCHER_DEFAULT_DEBOUNCE = 2 * time.Second
+)
+
+//
+// Watcher type, holds GoDutch to reload configuration, the directories being
+// watched and the amount of time to wait for changes to settle down.
+//
+type Watcher struct {
+	g        *GoDutch
+	dirs     []string
+	debounce time.Duration
+	stopCh   chan struct{}
+	logger   *Logger
+}
+
+// Creates a new watcher for the configuration directories of GoDutch. Informed
+// debounce is the amount of time without changes before reloading.
+func NewWatcher(g *GoDutch, debounce time.Duration) *Watcher {
+	var w *Watcher
+
+	if debounce <= 0 {
+		debounce = WATCHER_DEFAULT_DEBOUNCE
+	}
+
+	w = &Watcher{
+		g:        g,
+		dirs:     g.Config().Dirs(),
+		debounce: debounce,
+		stopCh:   make(chan struct{}),
+		logger:   g.Logger().With("component", "Watcher"),
+	}
+
+	return w
+}
+
+// Watches the configuration directories until stopped, reloading the
+// configuration after changes. Intended to run in background.
+func (w *Watcher) Serve() {
+	var events chan string = make(chan string, 16)
+	var errorCh chan error = make(chan error, 1)
+	var timer *time.Timer = time.NewTimer(w.debounce)
+	var pending bool = false
+	var name string
+	var diff *ConfigDiff
+	var err error
+
+	timer.Stop()
+
+	w.logger.Infof("Watching directories: '%v'", w.dirs)
+
+	go func() {
+		errorCh <- watchDirs(w.dirs, events, w.stopCh, w.logger)
+	}()
+
+	for {
+		select {
+		case name = <-events:
+			w.logger.Infof("Configuration file changed: '%s'", name)
+			// waiting for changes to settle down, timer starts over
+			if pending && !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(w.debounce)
+			pending = true
+		case <-timer.C:
+			pending = false
+			if diff, err = w.g.Reload(); err != nil {
+				w.logger.Errorf("Error on reloading configuration: %s", err)
+				continue
+			}
+			if diff.Empty() {
+				w.logger.Infof("No containers or services changed.")
+				continue
+			}
+			w.logger.Infof("Configuration reloaded, %s", diff)
+		case err = <-errorCh:
+			if err != nil {
+				w.logger.Errorf("Error on watching directories: %s", err)
+			}
+			return
+		case <-w.stopCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Stop watching the directories.
+func (w *Watcher) Stop() {
+	close(w.stopCh)
+}
+
+/* EOF */
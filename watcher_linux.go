@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package godutch
+
+//
+// Linux implementation of directories watching, using inotify.
+//
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// events on INI files that may change the configuration
+	WATCHER_INOTIFY_MASK = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+// Watches informed directories with inotify, sending the name of changed INI
+// files on events channel, until stopped.
+func watchDirs(dirs []string, events chan<- string, stopCh <-chan struct{}, logger *Logger) error {
+	var fd int
+	var file *os.File
+	var dir string
+	var buf []byte = make(
+		[]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	var n int
+	var offset int
+	var start int
+	var event *syscall.InotifyEvent
+	var name string
+	var err error
+
+	// non-blocking descriptor, so reading it can be interrupted by closing
+	fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	file = os.NewFile(uintptr(fd), "inotify")
+
+	for _, dir = range dirs {
+		if _, err = syscall.InotifyAddWatch(fd, dir, WATCHER_INOTIFY_MASK); err != nil {
+			file.Close()
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+	}
+
+	go func() {
+		<-stopCh
+		file.Close()
+	}()
+
+	for {
+		if n, err = file.Read(buf); err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		for offset = 0; offset+syscall.SizeofInotifyEvent <= n; {
+			// event is followed by file name, padded with NULL bytes
+			event = (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start = offset + syscall.SizeofInotifyEvent
+			name = strings.TrimRight(
+				string(buf[start:start+int(event.Len)]), "\x00")
+			offset = start + int(event.Len)
+
+			if !strings.HasSuffix(name, ".ini") {
+				continue
+			}
+
+			logger.Debugf("Event '%#x' on: '%s'", event.Mask, name)
+			select {
+			case events <- name:
+			case <-stopCh:
+				return nil
+			}
+		}
+	}
+}
+
+/* EOF */
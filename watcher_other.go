@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package godutch
+
+//
+// Directories watching is only available on Linux, elsewhere configuration is
+// reloaded manually.
+//
+
+import (
+	"errors"
+)
+
+// Informs directories watching is not supported on this platform.
+func watchDirs(dirs []string, events chan<- string, stopCh <-chan struct{}, logger *Logger) error {
+	return errors.New("Watching directories is only supported on Linux.")
+}
+
+/* EOF */
@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+package godutch_test
+
+import (
+	. "github.com/otaviof/godutch"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Waits for a check to be found, or not, on GoDutch inventory.
+func waitForCheck(g *GoDutch, name string, found bool) bool {
+	var i int
+	var err error
+
+	for i = 0; i < 100; i++ {
+		_, err = g.Execute(name, []string{})
+		if (err == nil) == found {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestWatcher(t *testing.T) {
+	var baseDir string
+	var containersDir string
+	var cfg *Config
+	var g *GoDutch
+	var w *Watcher
+	var err error
+
+	if baseDir, err = ioutil.TempDir("", "godutch-watcher"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	containersDir = filepath.Join(baseDir, "containers.d")
+	os.Mkdir(containersDir, 0700)
+	os.Mkdir(filepath.Join(baseDir, "services.d"), 0700)
+	ioutil.WriteFile(filepath.Join(baseDir, "godutch.ini"), []byte(
+		"[GoDutch]\ncontainers_dir = ./containers.d\n"+
+			"services_dir = ./services.d\n"), 0600)
+	writeHelperContainerINI(
+		t, filepath.Join(containersDir, "first.ini"), "first", "check_first")
+
+	Convey("Should load the initial configuration", t, func() {
+		cfg, err = NewConfig(filepath.Join(baseDir, "godutch.ini"))
+		So(err, ShouldEqual, nil)
+		So(cfg.Dirs(), ShouldResemble, []string{
+			filepath.Join(baseDir, "services.d"), containersDir})
+		g, err = NewGoDutch(cfg)
+		So(err, ShouldEqual, nil)
+		So(g.LoadContainers(), ShouldEqual, nil)
+	})
+	defer g.Stop()
+
+	w = NewWatcher(g, 200*time.Millisecond)
+	go w.Serve()
+	defer w.Stop()
+	// giving the watcher time to start watching directories
+	time.Sleep(500 * time.Millisecond)
+
+	Convey("Should load containers added to the directory", t, func() {
+		writeHelperContainerINI(t, filepath.Join(containersDir, "second.ini"),
+			"second", "check_second")
+		So(waitForCheck(g, "check_second", true), ShouldBeTrue)
+	})
+
+	Convey("Should unload containers removed from the directory", t, func() {
+		os.Remove(filepath.Join(containersDir, "first.ini"))
+		So(waitForCheck(g, "check_first", false), ShouldBeTrue)
+		So(waitForCheck(g, "check_second", true), ShouldBeTrue)
+	})
+}
+
+func TestWatcherFollowsReload(t *testing.T) {
+	var baseDir string
+	var containersDir string
+	var cfgPath string
+	var cfg *Config
+	var g *GoDutch
+	var err error
+
+	if baseDir, err = ioutil.TempDir("", "godutch-watcher-reload"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	containersDir = filepath.Join(baseDir, "containers.d")
+	cfgPath = filepath.Join(baseDir, "godutch.ini")
+	os.Mkdir(containersDir, 0700)
+	os.Mkdir(filepath.Join(baseDir, "services.d"), 0700)
+	ioutil.WriteFile(filepath.Join(baseDir, "services.d", "nrpe.ini"), []byte(
+		"[Service]\nenabled = 1\nname = nrpe\ntype = nrpe\n"+
+			"interface = 127.0.0.1\nport = 15780\n"), 0600)
+	ioutil.WriteFile(cfgPath, []byte(
+		"[GoDutch]\ncontainers_dir = ./containers.d\n"+
+			"services_dir = ./services.d\n"), 0600)
+	writeHelperContainerINI(
+		t, filepath.Join(containersDir, "first.ini"), "first", "check_first")
+
+	Convey("Should serve without watching the directories", t, func() {
+		cfg, err = NewConfig(cfgPath)
+		So(err, ShouldEqual, nil)
+		g, err = NewGoDutch(cfg)
+		So(err, ShouldEqual, nil)
+		So(g.LoadContainers(), ShouldEqual, nil)
+		So(g.LoadServices(), ShouldEqual, nil)
+		g.Serve()
+	})
+	defer g.Stop()
+
+	Convey("Should start watching once enabled on reload", t, func() {
+		ioutil.WriteFile(cfgPath, []byte(
+			"[GoDutch]\ncontainers_dir = ./containers.d\n"+
+				"services_dir = ./services.d\nwatch_config = 1\n"+
+				"watch_debounce = 1\n"), 0600)
+		_, err = g.Reload()
+		So(err, ShouldEqual, nil)
+		// giving the watcher time to start watching directories
+		time.Sleep(500 * time.Millisecond)
+
+		writeHelperContainerINI(t, filepath.Join(containersDir, "second.ini"),
+			"second", "check_second")
+		So(waitForCheck(g, "check_second", true), ShouldBeTrue)
+	})
+}
+
+/* EOF */